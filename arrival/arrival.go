@@ -0,0 +1,193 @@
+// Package arrival watches the deliveries expected from the partners of the flows.
+package arrival
+
+import (
+	"FileFlow/fileflows"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Statuses of an expectation for a day.
+const (
+	OnTime = "on_time"
+	Late   = "late"
+	Missed = "missed"
+)
+
+// businessDays are the days of the expectations without days.
+var businessDays = []string{"mon", "tue", "wed", "thu", "fri"}
+
+// Outcome is the new status of an expectation for a day.
+type Outcome struct {
+	Expectation string
+	Status      string
+	Deadline    time.Time
+	Files       int
+}
+
+// Monitor follows the expectations of a flow. A file counts for an expectation on the day the Monitor first sees it
+// in the source folder of the flow. A nil Monitor expects nothing.
+type Monitor struct {
+	expectations []*expectation
+	outcomes     []Outcome
+	// firstSeen holds the time each file of the source folder was first seen, across the days.
+	firstSeen map[string]time.Time
+}
+
+type expectation struct {
+	name     string
+	pattern  *regexp.Regexp
+	minFiles int
+	deadline time.Duration
+	days     map[time.Weekday]bool
+
+	day    time.Time
+	seen   map[string]bool
+	status string
+}
+
+// FromConfig creates the Monitor of the expectations of the flow. It returns nil when the flow expects nothing.
+func FromConfig(flow fileflows.FileFlow) (*Monitor, error) {
+	if len(flow.Expectations) == 0 {
+		return nil, nil
+	}
+
+	m := &Monitor{firstSeen: make(map[string]time.Time)}
+	for i, config := range flow.Expectations {
+		e, err := newExpectation(config)
+		if err != nil {
+			return nil, fmt.Errorf("expectation %d: %w", i+1, err)
+		}
+		m.expectations = append(m.expectations, e)
+	}
+	return m, nil
+}
+
+func newExpectation(config fileflows.Expectation) (*expectation, error) {
+	e := &expectation{name: config.Name, minFiles: config.MinFiles, days: make(map[time.Weekday]bool)}
+	if e.name == "" {
+		return nil, fmt.Errorf("expectation needs a name")
+	}
+	if e.minFiles <= 0 {
+		e.minFiles = 1
+	}
+
+	var err error
+	if e.pattern, err = regexp.Compile(config.Pattern); err != nil {
+		return nil, fmt.Errorf("invalid pattern %s: %w", config.Pattern, err)
+	}
+	if e.deadline, err = fileflows.ParseTimeOfDay(config.Deadline); err != nil {
+		return nil, fmt.Errorf("deadline: %w", err)
+	}
+
+	days := config.Days
+	if len(days) == 0 {
+		days = businessDays
+	}
+	for _, day := range days {
+		weekday, err := parseWeekday(day)
+		if err != nil {
+			return nil, err
+		}
+		e.days[weekday] = true
+	}
+	return e, nil
+}
+
+// parseWeekday parses the name of a day of the week, in full or in three letters.
+func parseWeekday(day string) (time.Weekday, error) {
+	for weekday := time.Sunday; weekday <= time.Saturday; weekday++ {
+		name := strings.ToLower(weekday.String())
+		if value := strings.ToLower(day); value == name || value == name[:3] {
+			return weekday, nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not a day of the week", day)
+}
+
+// Seen counts the files found in the source folder of the flow at the time. A file is counted once, on the day it's
+// first seen: a file left in the source folder (waiting for a destination folder for instance) doesn't count again
+// on the next days. A file that leaves the source folder and comes back is a new file.
+func (m *Monitor) Seen(files []string, now time.Time) {
+	if m == nil {
+		return
+	}
+
+	listed := make(map[string]bool, len(files))
+	for _, file := range files {
+		listed[file] = true
+		if _, seen := m.firstSeen[file]; !seen {
+			m.firstSeen[file] = now
+		}
+	}
+	for file := range m.firstSeen {
+		if !listed[file] {
+			delete(m.firstSeen, file)
+		}
+	}
+
+	for _, e := range m.expectations {
+		m.roll(e, now)
+		for _, file := range files {
+			if e.pattern.MatchString(path.Base(file)) && !m.firstSeen[file].Before(e.day) {
+				e.seen[file] = true
+			}
+		}
+
+		if !e.days[now.Weekday()] || len(e.seen) < e.minFiles {
+			continue
+		}
+		switch {
+		case e.status == "" && !now.After(e.day.Add(e.deadline)):
+			m.report(e, OnTime)
+		case e.status == "" || e.status == Missed:
+			m.report(e, Late)
+		}
+	}
+}
+
+// Check returns the new statuses of the expectations since the last check. The expectations whose deadline is past
+// without enough files are missed.
+func (m *Monitor) Check(now time.Time) []Outcome {
+	if m == nil {
+		return nil
+	}
+
+	for _, e := range m.expectations {
+		m.roll(e, now)
+		if e.days[now.Weekday()] && e.status == "" && now.After(e.day.Add(e.deadline)) {
+			m.report(e, Missed)
+		}
+	}
+
+	outcomes := m.outcomes
+	m.outcomes = nil
+	return outcomes
+}
+
+// roll starts the day of the time for the expectation. The previous day is missed if it was expected and nothing
+// reported it yet.
+func (m *Monitor) roll(e *expectation, now time.Time) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if day.Equal(e.day) {
+		return
+	}
+
+	if !e.day.IsZero() && e.days[e.day.Weekday()] && e.status == "" {
+		m.report(e, Missed)
+	}
+	e.day, e.seen, e.status = day, make(map[string]bool), ""
+}
+
+func (m *Monitor) report(e *expectation, status string) {
+	e.status = status
+	m.outcomes = append(m.outcomes, Outcome{
+		Expectation: e.name,
+		Status:      status,
+		Deadline:    e.day.Add(e.deadline),
+		Files:       len(e.seen),
+	})
+}
@@ -0,0 +1,85 @@
+package arrival
+
+import (
+	"FileFlow/fileflows"
+	"testing"
+	"time"
+)
+
+func TestExpectations(t *testing.T) {
+	// Given
+	flow := fileflows.FileFlow{Name: "ACME", Expectations: []fileflows.Expectation{
+		{Name: "reports", Pattern: `^report_.*\.csv$`, MinFiles: 2, Deadline: "07:00"},
+	}}
+	monday := time.Date(2023, 6, 5, 0, 0, 0, 0, time.Local)
+	at := func(day int, hour int, minute int) time.Time {
+		return monday.AddDate(0, 0, day).Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+
+	type step struct {
+		files []string
+		now   time.Time
+	}
+	var tests = []struct {
+		name     string
+		steps    []step
+		expected []string
+	}{
+		{"On time", []step{{[]string{"report_A.csv"}, at(0, 6, 0)}, {[]string{"report_A.csv", "report_B.csv"}, at(0, 6, 59)}}, []string{OnTime}},
+		{"Same file seen twice", []step{{[]string{"report_A.csv"}, at(0, 6, 0)}, {[]string{"report_A.csv"}, at(0, 6, 30)}}, nil},
+		{"Other files ignored", []step{{[]string{"report_A.csv", "invoice.csv"}, at(0, 6, 0)}, {nil, at(0, 7, 1)}}, []string{Missed}},
+		{"Missed then late", []step{{[]string{"report_A.csv"}, at(0, 7, 1)}, {[]string{"report_B.csv"}, at(0, 9, 0)}}, []string{Missed, Late}},
+		{"Missed at the next day", []step{{nil, at(0, 6, 0)}, {[]string{"report_A.csv", "report_B.csv"}, at(1, 5, 0)}}, []string{Missed, OnTime}},
+		{"Files lingering past midnight", []step{{[]string{"report_A.csv", "report_B.csv"}, at(0, 6, 0)}, {[]string{"report_A.csv", "report_B.csv"}, at(1, 6, 0)}, {[]string{"report_A.csv", "report_B.csv"}, at(1, 8, 0)}}, []string{OnTime, Missed}},
+		{"Nothing expected on week-ends", []step{{nil, at(5, 6, 0)}, {nil, at(6, 8, 0)}}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			monitor, err := FromConfig(flow)
+			if err != nil {
+				t.Fatalf("Error creating monitor: %s", err)
+			}
+
+			// When
+			var got []string
+			for _, s := range test.steps {
+				monitor.Seen(s.files, s.now)
+				for _, outcome := range monitor.Check(s.now) {
+					got = append(got, outcome.Status)
+				}
+			}
+
+			// Then
+			if len(got) != len(test.expected) {
+				t.Fatalf("Expected outcomes %v, got %v", test.expected, got)
+			}
+			for i := range got {
+				if got[i] != test.expected[i] {
+					t.Errorf("Expected outcomes %v, got %v", test.expected, got)
+				}
+			}
+		})
+	}
+}
+
+func TestExpectationsConfiguration(t *testing.T) {
+	var tests = []struct {
+		expectation fileflows.Expectation
+		valid       bool
+	}{
+		{fileflows.Expectation{Name: "reports", Deadline: "07:00"}, true},
+		{fileflows.Expectation{Name: "reports", Deadline: "07:00", Days: []string{"Sat", "sunday"}}, true},
+		{fileflows.Expectation{Deadline: "07:00"}, false},
+		{fileflows.Expectation{Name: "reports", Deadline: "7h"}, false},
+		{fileflows.Expectation{Name: "reports", Deadline: "07:00", Pattern: "("}, false},
+		{fileflows.Expectation{Name: "reports", Deadline: "07:00", Days: []string{"holiday"}}, false},
+	}
+
+	for _, test := range tests {
+		flow := fileflows.FileFlow{Name: "ACME", Expectations: []fileflows.Expectation{test.expectation}}
+		if _, err := FromConfig(flow); (err == nil) != test.valid {
+			t.Errorf("Expectation %+v: expected valid %v, got error %v", test.expectation, test.valid, err)
+		}
+	}
+}
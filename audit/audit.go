@@ -0,0 +1,227 @@
+// Package audit records the outcome of the file transfers into an append-only journal of JSON lines, and searches it.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Default rotation of the audit journal.
+const (
+	DefaultMaxSize  = 100 << 20
+	DefaultMaxFiles = 10
+)
+
+// Results of the transfers.
+const (
+	Delivered  = "delivered"
+	Overflowed = "overflowed"
+	Failed     = "failed"
+	// Deferred is the result of a file left in the source folder because no folder is available for it.
+	Deferred = "deferred"
+	// Rejected is the result of a file left in the source folder because it can't be dispatched.
+	Rejected = "rejected"
+)
+
+// Record is the outcome of the transfer of a file.
+type Record struct {
+	Time        time.Time     `json:"time"`
+	Flow        string        `json:"flow"`
+	Source      string        `json:"source"`
+	Destination string        `json:"destination,omitempty"`
+	Size        int64         `json:"size"`
+	Hash        string        `json:"sha256,omitempty"`
+	Operation   string        `json:"operation"`
+	Duration    time.Duration `json:"duration"`
+	Result      string        `json:"result"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// Log is an audit journal. Its file is rotated when it reaches its maximum size: the file is renamed with the .1
+// suffix, the previous .1 file with the .2 suffix, and so on up to the maximum number of files.
+// A Log may be used by many goroutines at the same time. A nil Log records nothing.
+type Log struct {
+	name     string
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// Open opens (or creates) the audit journal. The journal is rotated when it reaches maxSize bytes and keeps maxFiles
+// files (the current one included). Zero values use DefaultMaxSize and DefaultMaxFiles.
+func Open(name string, maxSize int64, maxFiles int) (*Log, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+
+	l := &Log{name: name, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("cannot open audit journal %s: %w", l.name, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("cannot open audit journal %s: %w", l.name, err)
+	}
+	l.file = f
+	l.size = info.Size()
+	return nil
+}
+
+// Close closes the audit journal.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Write appends the record to the audit journal.
+func (l *Log) Write(record Record) error {
+	if l == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("cannot write audit journal %s: %w", l.name, err)
+	}
+	return nil
+}
+
+// rotate renames the files of the journal and opens a new one. The Log must be locked.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+
+	_ = os.Remove(rotated(l.name, l.maxFiles-1))
+	for i := l.maxFiles - 2; i >= 0; i-- {
+		if err := os.Rename(rotated(l.name, i), rotated(l.name, i+1)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot rotate audit journal %s: %w", l.name, err)
+		}
+	}
+
+	return l.open()
+}
+
+// rotated returns the name of the ith file of the journal, 0 being the current one.
+func rotated(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s.%d", name, i)
+}
+
+// Query selects the records of a search. The zero values select all the records.
+type Query struct {
+	// Flow is the name of the flow of the records.
+	Flow string
+	// Pattern matches the file names (without folder) of the sources of the records.
+	Pattern *regexp.Regexp
+	// From and To bound the times of the records (From included, To excluded).
+	From time.Time
+	To   time.Time
+}
+
+// Matches tells if the record is selected by the query.
+func (q Query) Matches(record Record) bool {
+	if q.Flow != "" && record.Flow != q.Flow {
+		return false
+	}
+	if q.Pattern != nil && !q.Pattern.MatchString(path.Base(record.Source)) {
+		return false
+	}
+	if !q.From.IsZero() && record.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !record.Time.Before(q.To) {
+		return false
+	}
+	return true
+}
+
+// Search calls found for each record of the audit journal (rotated files included) selected by the query, from the
+// oldest to the newest.
+func Search(name string, query Query, found func(Record)) error {
+	var names []string
+	for i := 0; ; i++ {
+		if _, err := os.Stat(rotated(name, i)); err != nil {
+			if os.IsNotExist(err) && i > 0 {
+				break
+			}
+			return err
+		}
+		names = append([]string{rotated(name, i)}, names...)
+	}
+
+	for _, n := range names {
+		if err := searchFile(n, query, found); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func searchFile(name string, query Query, found func(Record)) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// The last line may be incomplete after a crash.
+			slog.Warn("Ignoring invalid audit record", "file", name, "line", line, "error", err)
+			continue
+		}
+		if query.Matches(record) {
+			found(record)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSearchRecords(t *testing.T) {
+	// Given
+	name := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := Open(name, 0, 0)
+	if err != nil {
+		t.Fatalf("Error opening audit journal: %s", err)
+	}
+	day := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	records := []Record{
+		{Time: day.Add(1 * time.Hour), Flow: "ACME", Source: "sftp/acme/file_A.csv", Result: Delivered},
+		{Time: day.Add(2 * time.Hour), Flow: "ACME", Source: "sftp/acme/file_B.txt", Result: Delivered},
+		{Time: day.Add(3 * time.Hour), Flow: "Wayne", Source: "sftp/wayne/file_C.csv", Result: Failed, Error: "full"},
+		{Time: day.Add(26 * time.Hour), Flow: "ACME", Source: "sftp/acme/file_D.csv", Result: Overflowed},
+	}
+	for _, r := range records {
+		if err := log.Write(r); err != nil {
+			t.Fatalf("Error writing record: %s", err)
+		}
+	}
+	_ = log.Close()
+
+	var tests = []struct {
+		query    Query
+		expected []string
+	}{
+		{Query{}, []string{"file_A.csv", "file_B.txt", "file_C.csv", "file_D.csv"}},
+		{Query{Flow: "ACME"}, []string{"file_A.csv", "file_B.txt", "file_D.csv"}},
+		{Query{Pattern: regexp.MustCompile(`\.csv$`)}, []string{"file_A.csv", "file_C.csv", "file_D.csv"}},
+		{Query{From: day.Add(2 * time.Hour), To: day.Add(24 * time.Hour)}, []string{"file_B.txt", "file_C.csv"}},
+		{Query{Flow: "ACME", Pattern: regexp.MustCompile(`^file_D`)}, []string{"file_D.csv"}},
+	}
+
+	for _, test := range tests {
+		// When
+		var found []string
+		err := Search(name, test.query, func(r Record) {
+			found = append(found, filepath.Base(r.Source))
+		})
+
+		// Then
+		if err != nil {
+			t.Fatalf("Error searching audit journal: %s", err)
+		}
+
+		if len(found) != len(test.expected) {
+			t.Errorf("Expected %v, got %v", test.expected, found)
+			continue
+		}
+		for i := range found {
+			if found[i] != test.expected[i] {
+				t.Errorf("Expected %v, got %v", test.expected, found)
+				break
+			}
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	// Given
+	name := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := Open(name, 200, 3)
+	if err != nil {
+		t.Fatalf("Error opening audit journal: %s", err)
+	}
+	defer log.Close()
+
+	// When
+	for i := 0; i < 10; i++ {
+		record := Record{Time: time.Unix(int64(i), 0).UTC(), Flow: "ACME", Source: "sftp/acme/file", Result: Delivered}
+		if err := log.Write(record); err != nil {
+			t.Fatalf("Error writing record: %s", err)
+		}
+	}
+
+	// Then
+	for _, n := range []string{name, name + ".1", name + ".2"} {
+		info, err := os.Stat(n)
+		if err != nil {
+			t.Errorf("File should be found: %s", n)
+		} else if info.Size() > 200 {
+			t.Errorf("Expected at most 200 bytes in %s, got %d", n, info.Size())
+		}
+	}
+
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Errorf("File should be removed: %s", name+".3")
+	}
+
+	var last time.Time
+	err = Search(name, Query{}, func(r Record) {
+		if r.Time.Before(last) {
+			t.Errorf("Expected records from the oldest to the newest, got %s after %s", r.Time, last)
+		}
+		last = r.Time
+	})
+	if err != nil {
+		t.Errorf("Error searching audit journal: %s", err)
+	}
+
+	if !last.Equal(time.Unix(9, 0)) {
+		t.Errorf("Expected the last record to be found, got %s", last)
+	}
+}
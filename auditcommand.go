@@ -0,0 +1,109 @@
+package main
+
+import (
+	"FileFlow/audit"
+	"FileFlow/fileflows"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"text/tabwriter"
+	"time"
+)
+
+// runAudit runs the audit command searching the audit journal of a configuration. It returns the exit code.
+//
+//	FileFlow audit [-flow name] [-pattern regexp] [-from time] [-to time] <config file>
+func runAudit(args []string) int {
+	cmd := flag.NewFlagSet("audit", flag.ContinueOnError)
+	flow := cmd.String("flow", "", "name of the flow")
+	pattern := cmd.String("pattern", "", "regular expression matching the source file names")
+	from := cmd.String("from", "", "first time of the transfers (RFC 3339 time or YYYY-MM-DD date)")
+	to := cmd.String("to", "", "time after the transfers (RFC 3339 time or YYYY-MM-DD date)")
+	cmd.Usage = func() {
+		fmt.Fprintln(cmd.Output(), "Usage: FileFlow audit [options] <config file>")
+		cmd.PrintDefaults()
+	}
+	if err := cmd.Parse(args); err != nil {
+		return 2
+	}
+	if cmd.NArg() != 1 {
+		cmd.Usage()
+		return 2
+	}
+
+	query, err := auditQuery(*flow, *pattern, *from, *to)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	config, err := fileflows.LoadConfig(cmd.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if config.Audit.Path == "" {
+		fmt.Fprintln(os.Stderr, "no audit journal in the configuration")
+		return 1
+	}
+
+	if err := printAudit(os.Stdout, config.Audit.Path, query); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// auditQuery builds the query of the audit command options.
+func auditQuery(flow string, pattern string, from string, to string) (audit.Query, error) {
+	query := audit.Query{Flow: flow}
+
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return query, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+		}
+		query.Pattern = re
+	}
+
+	var err error
+	if query.From, err = parseAuditTime(from); err != nil {
+		return query, err
+	}
+	if query.To, err = parseAuditTime(to); err != nil {
+		return query, err
+	}
+	return query, nil
+}
+
+// parseAuditTime parses a RFC 3339 time or a YYYY-MM-DD date (midnight, local time). An empty value is the zero time.
+func parseAuditTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s: expected RFC 3339 time or YYYY-MM-DD date", value)
+}
+
+// printAudit prints the records of the audit journal selected by the query, one per line.
+func printAudit(out io.Writer, journal string, query audit.Query) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tFLOW\tRESULT\tOPERATION\tSOURCE\tDESTINATION\tSIZE\tSHA256\tDURATION\tERROR")
+
+	err := audit.Search(journal, query, func(r audit.Record) {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n",
+			r.Time.Format(time.RFC3339), r.Flow, r.Result, r.Operation, r.Source, r.Destination, r.Size, r.Hash,
+			r.Duration.Round(time.Millisecond), r.Error)
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"FileFlow/logging"
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// daemon runs the cycles of the flows until it's shut down.
+// The flows can be paused, resumed and triggered while the daemon runs.
+type daemon struct {
+	runners []*flowRunner
+	delay   time.Duration
+	grace   time.Duration
+
+	done     chan struct{}
+	shutOnce sync.Once
+
+	// ctx is the context of the transfers, canceled when they are aborted.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	abortOnce sync.Once
+}
+
+// newDaemon returns the daemon of the flows. After the shutdown, the transfers in progress have the grace period to
+// finish before they are aborted.
+func newDaemon(runners []*flowRunner, delay time.Duration, grace time.Duration) *daemon {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &daemon{runners: runners, delay: delay, grace: grace, done: make(chan struct{}), ctx: ctx, cancel: cancel}
+	for _, runner := range runners {
+		runner.stop = d.done
+	}
+	return d
+}
+
+// run runs the flows and returns when all of them are finished after the shutdown.
+func (d *daemon) run() {
+	var wg sync.WaitGroup
+	for _, runner := range d.runners {
+		wg.Add(1)
+		go func(runner *flowRunner) {
+			defer wg.Done()
+			d.loop(runner)
+			_ = runner.journal.Close()
+			logging.ForFlow(runner.flow.Name).Info("Flow finished")
+		}(runner)
+	}
+	wg.Wait()
+	d.cancel()
+}
+
+// loop runs the cycles of the flow, one every delay or when the flow is triggered, until the shutdown.
+// The cycle in progress stops after its transfers in progress before the flow stops.
+func (d *daemon) loop(runner *flowRunner) {
+	for {
+		if d.shuttingDown() {
+			return
+		}
+		if !runner.isPaused() {
+			runner.cycle(d.ctx)
+		}
+
+		select {
+		case <-d.done:
+			return
+		case <-runner.trigger:
+		case <-time.After(d.delay):
+		}
+	}
+}
+
+// shutdown asks the flows to stop after their transfers in progress: no new transfer is started. The transfers still
+// in progress at the end of the grace period are aborted.
+func (d *daemon) shutdown() {
+	d.shutOnce.Do(func() {
+		slog.Info("FileFlow is shutting down", "grace", d.grace)
+		close(d.done)
+		time.AfterFunc(d.grace, d.abort)
+	})
+}
+
+// abort aborts the transfers in progress at once. The aborted transfers leave their source files in place and no
+// partial file behind.
+func (d *daemon) abort() {
+	d.abortOnce.Do(func() {
+		if d.ctx.Err() == nil {
+			slog.Warn("Aborting the transfers in progress")
+		}
+		d.cancel()
+	})
+}
+
+func (d *daemon) shuttingDown() bool {
+	select {
+	case <-d.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// runner returns the runner of the flow with the name, nil if there is none.
+func (d *daemon) runner(name string) *flowRunner {
+	for _, runner := range d.runners {
+		if runner.flow.Name == name {
+			return runner
+		}
+	}
+	return nil
+}
+
+// cycleResult is the result of a cycle of a flow.
+type cycleResult struct {
+	Start      time.Time `json:"start"`
+	Duration   float64   `json:"duration_seconds"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	Files      int       `json:"files"`
+	Dispatched int       `json:"dispatched"`
+	Failed     int       `json:"failed"`
+	Waiting    int       `json:"waiting"`
+}
+
+// flowStatus is the state of a flow.
+type flowStatus struct {
+	Name      string       `json:"name"`
+	State     string       `json:"state"`
+	Backlog   int          `json:"backlog"`
+	LastCycle *cycleResult `json:"last_cycle,omitempty"`
+}
+
+// States of the flows.
+const (
+	stateIdle    = "idle"
+	stateRunning = "running"
+	statePaused  = "paused"
+)
+
+// status returns the state of the flow. The backlog is the number of source files left by the last cycle.
+func (r *flowRunner) status() flowStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := flowStatus{Name: r.flow.Name, State: stateIdle}
+	switch {
+	case r.running:
+		status.State = stateRunning
+	case r.paused:
+		status.State = statePaused
+	}
+	if r.last != nil {
+		last := *r.last
+		status.LastCycle = &last
+		status.Backlog = last.Files - last.Dispatched
+	}
+	return status
+}
+
+func (r *flowRunner) isPaused() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.paused
+}
+
+// pause stops the cycles of the flow after the one in progress, if any.
+func (r *flowRunner) pause() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.paused = true
+}
+
+// resume restarts the cycles of a paused flow.
+func (r *flowRunner) resume() {
+	r.mu.Lock()
+	r.paused = false
+	r.mu.Unlock()
+	r.runNow()
+}
+
+// runNow starts a cycle of the flow without waiting for the delay. It tells if the flow runs: a paused flow doesn't.
+func (r *flowRunner) runNow() bool {
+	if r.isPaused() {
+		return false
+	}
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+		// A cycle is already triggered.
+	}
+	return true
+}
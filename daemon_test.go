@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestShutdownAbortsTransfersAfterGrace(t *testing.T) {
+	// Given
+	grace := 50 * time.Millisecond
+	d := newDaemon(nil, time.Hour, grace)
+
+	// When
+	start := time.Now()
+	d.shutdown()
+
+	// Then
+	if !d.shuttingDown() || d.ctx.Err() != nil {
+		t.Fatalf("Expected the transfers to go on during the grace period")
+	}
+	select {
+	case <-d.ctx.Done():
+		if elapsed := time.Since(start); elapsed < grace {
+			t.Errorf("Expected the transfers to be aborted after %s, got %s", grace, elapsed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the transfers to be aborted")
+	}
+}
+
+func TestAbortDuringShutdown(t *testing.T) {
+	// Given
+	d := newDaemon(nil, time.Hour, time.Hour)
+	d.shutdown()
+
+	// When
+	d.abort()
+
+	// Then
+	if d.ctx.Err() == nil {
+		t.Errorf("Expected the transfers to be aborted at once")
+	}
+}
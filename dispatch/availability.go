@@ -0,0 +1,458 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"FileFlow/files"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileAvailability is a FolderAvailability whose answer also depends on the file to dispatch.
+// When the dispatched file is known, the Dispatcher calls IsAvailableFor instead of IsAvailable.
+type FileAvailability interface {
+	FolderAvailability
+	IsAvailableFor(folder string, file os.FileInfo) bool
+}
+
+// FileRule is a FileAvailability able to tell whether a file could be accepted at all, whatever the content of the
+// folders: Accepts is true when the file fits an empty folder.
+// A file that no folder could ever accept is rejected instead of being moved into the overflow folder, where it
+// would block the draining forever.
+type FileRule interface {
+	FileAvailability
+	Accepts(file os.FileInfo) bool
+}
+
+// accepts tells whether fa could accept the file into an empty folder. Without a file rule (or a known file), any
+// file is accepted.
+func accepts(fa FolderAvailability, file os.FileInfo) bool {
+	if fr, ok := fa.(FileRule); ok && file != nil {
+		return fr.Accepts(file)
+	}
+	return true
+}
+
+// FillLevel is a FolderAvailability able to tell how full a folder is.
+type FillLevel interface {
+	FolderAvailability
+	// Fill returns the used part of the folder capacity, from 0 (empty) to 1 (full). known is false when the folder
+	// has no capacity limit or can't be checked.
+	Fill(folder string) (fill float64, known bool)
+}
+
+// FolderFill returns the fill level of the folder, if fa can tell it.
+func FolderFill(fa FolderAvailability, folder string) (fill float64, known bool) {
+	if fl, ok := fa.(FillLevel); ok {
+		return fl.Fill(folder)
+	}
+	return 0, false
+}
+
+// AvailabilityBuilder creates the FolderAvailability described by a rule of the flow configuration.
+type AvailabilityBuilder func(rule fileflows.AvailabilityRule) (FolderAvailability, error)
+
+var (
+	availabilitiesMu sync.RWMutex
+	availabilities   = map[string]AvailabilityBuilder{
+		"file_count":   newFileCountRule,
+		"folder_bytes": newFolderBytesRule,
+		"file_size":    newFileSizeRule,
+		"free_space":   newFreeSpaceRule,
+		"pause_file":   newPauseFileRule,
+		"time_window":  newTimeWindowRule,
+	}
+)
+
+// RegisterAvailability makes a FolderAvailability available under the name for the availability rules of the flows.
+// It replaces any rule already registered with the same name.
+func RegisterAvailability(name string, builder AvailabilityBuilder) {
+	availabilitiesMu.Lock()
+	defer availabilitiesMu.Unlock()
+	availabilities[name] = builder
+}
+
+// NewFolderAvailability returns the FolderAvailability matching the limits set in the flow.
+// All limits (including the availability rule of the flow, if any) must be satisfied for a folder to be available.
+func NewFolderAvailability(flow *fileflows.FileFlow) (FolderAvailability, error) {
+	limits := []FolderAvailability{
+		ByFileCount{MaxFileCount: flow.MaxFileCount},
+		ByFolderBytes{MaxBytes: flow.MaxFolderBytes},
+		ByFileSize{MinSize: flow.MinFileSize, MaxSize: flow.MaxFileSize},
+		ByFreeSpace{Reserve: flow.FreeSpaceReserve, Ratio: deliveryRatio(flow)},
+	}
+
+	if flow.Availability != nil {
+		fa, err := NewAvailabilityRule(*flow.Availability)
+		if err != nil {
+			return nil, err
+		}
+		limits = append(limits, fa)
+	}
+
+	return All(limits...), nil
+}
+
+// defaultDecompressionRatio is the size of a decompressed file for a byte of the compressed file, when the flow
+// doesn't set it. The real size is only known once the file is decompressed.
+const defaultDecompressionRatio = 4
+
+// deliveryRatio returns the size of the delivered files for a byte of the source files of the flow.
+func deliveryRatio(flow *fileflows.FileFlow) float64 {
+	if flow.Operation != fileflows.Decompression {
+		return 1
+	}
+	if flow.DecompressionRatio == 0 {
+		return defaultDecompressionRatio
+	}
+	return flow.DecompressionRatio
+}
+
+// NewAvailabilityRule creates the FolderAvailability described by the rule.
+func NewAvailabilityRule(rule fileflows.AvailabilityRule) (FolderAvailability, error) {
+	switch rule.Type {
+	case "all":
+		availabilities, err := newSubRules(rule)
+		if err != nil {
+			return nil, err
+		}
+		return All(availabilities...), nil
+	case "any":
+		availabilities, err := newSubRules(rule)
+		if err != nil {
+			return nil, err
+		}
+		return Any(availabilities...), nil
+	}
+
+	availabilitiesMu.RLock()
+	builder, ok := availabilities[rule.Type]
+	availabilitiesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown availability rule %q", rule.Type)
+	}
+	return builder(rule)
+}
+
+// ByFileCount limits the number of files in a folder. A zero maximum means no limit.
+// The files being transferred into the folder are counted.
+type ByFileCount struct {
+	MaxFileCount int
+}
+
+func (a ByFileCount) IsAvailable(folder string) bool {
+	if a.MaxFileCount == 0 {
+		return true
+	}
+
+	count := files.CountFiles(folder)
+	pendingFiles, _ := inflight.pending(folder)
+	return count > -1 && count+pendingFiles < a.MaxFileCount
+}
+
+func (a ByFileCount) Fill(folder string) (float64, bool) {
+	count := files.CountFiles(folder)
+	if a.MaxFileCount == 0 || count == -1 {
+		return 0, false
+	}
+	return float64(count) / float64(a.MaxFileCount), true
+}
+
+// ByFolderBytes limits the total size in bytes of the files in a folder. A zero maximum means no limit.
+// When the file is known, the folder is available only if the file fits in the remaining room.
+// The files being transferred into the folder are counted with their full size.
+type ByFolderBytes struct {
+	MaxBytes int64
+}
+
+func (a ByFolderBytes) IsAvailable(folder string) bool {
+	if a.MaxBytes == 0 {
+		return true
+	}
+
+	size := files.FolderSize(folder)
+	_, pendingBytes := inflight.pending(folder)
+	return size > -1 && size+pendingBytes < a.MaxBytes
+}
+
+func (a ByFolderBytes) IsAvailableFor(folder string, file os.FileInfo) bool {
+	if a.MaxBytes == 0 {
+		return true
+	}
+
+	size := files.FolderSize(folder)
+	_, pendingBytes := inflight.pending(folder)
+	return size > -1 && size+pendingBytes+file.Size() <= a.MaxBytes
+}
+
+func (a ByFolderBytes) Accepts(file os.FileInfo) bool {
+	return a.MaxBytes == 0 || file.Size() <= a.MaxBytes
+}
+
+func (a ByFolderBytes) Fill(folder string) (float64, bool) {
+	size := files.FolderSize(folder)
+	if a.MaxBytes == 0 || size == -1 {
+		return 0, false
+	}
+	return float64(size) / float64(a.MaxBytes), true
+}
+
+// ByFileSize accepts only the files whose size is between MinSize and MaxSize (both included).
+// A zero bound means no limit. Without a known file, any folder is available.
+type ByFileSize struct {
+	MinSize int64
+	MaxSize int64
+}
+
+func (a ByFileSize) IsAvailable(_ string) bool {
+	return true
+}
+
+func (a ByFileSize) IsAvailableFor(_ string, file os.FileInfo) bool {
+	if a.MinSize > 0 && file.Size() < a.MinSize {
+		return false
+	}
+	return a.MaxSize == 0 || file.Size() <= a.MaxSize
+}
+
+func (a ByFileSize) Accepts(file os.FileInfo) bool {
+	return a.IsAvailableFor("", file)
+}
+
+// ByFreeSpace checks the free space of the filesystem of a folder. Reserve is the number of bytes that must stay
+// free on the filesystem. When the file is known, the folder is available only if the delivered file fits without
+// eating the reserve. Ratio is the size of the delivered file for a byte of the file, for the operations making the
+// files bigger (decompression); zero means 1. The files being transferred into the folder are deducted from the free
+// space with their full size.
+// On platforms where the free space is unknown, any folder is available.
+type ByFreeSpace struct {
+	Reserve int64
+	Ratio   float64
+}
+
+func (a ByFreeSpace) IsAvailable(folder string) bool {
+	free, known := freeSpace(folder)
+	return !known || free > a.Reserve
+}
+
+func (a ByFreeSpace) IsAvailableFor(folder string, file os.FileInfo) bool {
+	size := file.Size()
+	if a.Ratio > 0 {
+		size = int64(float64(size) * a.Ratio)
+	}
+	free, known := freeSpace(folder)
+	return !known || free-size >= a.Reserve
+}
+
+// freeSpace returns the free space of the folder filesystem. known is false when the platform can't tell it.
+// If the folder can't be checked, the free space is -1.
+func freeSpace(folder string) (free int64, known bool) {
+	free, err := files.FreeSpace(folder)
+	if errors.Is(err, files.ErrFreeSpaceUnsupported) {
+		return 0, false
+	}
+	if err != nil {
+		return -1, true
+	}
+	_, pendingBytes := inflight.pending(folder)
+	return free - pendingBytes, true
+}
+
+// ByPauseFile makes a folder unavailable while it contains a file with the given name (a PAUSE or .lock file
+// for instance).
+type ByPauseFile struct {
+	Name string
+}
+
+func (a ByPauseFile) IsAvailable(folder string) bool {
+	_, err := os.Stat(ConcatFolderWithFile(folder, a.Name))
+	return os.IsNotExist(err)
+}
+
+// ByTimeWindow makes the folders available only during a window of the day. From and To are durations since
+// midnight (local time). When To is before From, the window goes over midnight.
+type ByTimeWindow struct {
+	From time.Duration
+	To   time.Duration
+	now  func() time.Time
+}
+
+func (a ByTimeWindow) IsAvailable(_ string) bool {
+	now := time.Now
+	if a.now != nil {
+		now = a.now
+	}
+	return fileflows.InTimeWindow(a.From, a.To, now())
+}
+
+// All combines many FolderAvailability. A folder is available when all of them say so.
+func All(availabilities ...FolderAvailability) FolderAvailability {
+	return allAvailability(availabilities)
+}
+
+type allAvailability []FolderAvailability
+
+func (a allAvailability) IsAvailable(folder string) bool {
+	for _, fa := range a {
+		if !fa.IsAvailable(folder) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a allAvailability) IsAvailableFor(folder string, file os.FileInfo) bool {
+	for _, fa := range a {
+		if !isAvailable(fa, folder, file) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a allAvailability) Accepts(file os.FileInfo) bool {
+	for _, fa := range a {
+		if !accepts(fa, file) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fill returns the highest fill level of the combined FolderAvailability, as the first full one makes the folder
+// unavailable.
+func (a allAvailability) Fill(folder string) (fill float64, known bool) {
+	for _, fa := range a {
+		if f, ok := FolderFill(fa, folder); ok && (!known || f > fill) {
+			fill, known = f, true
+		}
+	}
+	return fill, known
+}
+
+// isAvailable checks the folder availability for the file, if the file is known and fa depends on it.
+func isAvailable(fa FolderAvailability, folder string, file os.FileInfo) bool {
+	if faf, ok := fa.(FileAvailability); ok && file != nil {
+		return faf.IsAvailableFor(folder, file)
+	}
+	return fa.IsAvailable(folder)
+}
+
+// Any combines many FolderAvailability. A folder is available when at least one of them says so.
+func Any(availabilities ...FolderAvailability) FolderAvailability {
+	return anyAvailability(availabilities)
+}
+
+type anyAvailability []FolderAvailability
+
+func (a anyAvailability) IsAvailable(folder string) bool {
+	for _, fa := range a {
+		if fa.IsAvailable(folder) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a anyAvailability) IsAvailableFor(folder string, file os.FileInfo) bool {
+	for _, fa := range a {
+		if isAvailable(fa, folder, file) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a anyAvailability) Accepts(file os.FileInfo) bool {
+	for _, fa := range a {
+		if accepts(fa, file) {
+			return true
+		}
+	}
+	return false
+}
+
+// Fill returns the lowest fill level of the combined FolderAvailability, as the folder is available until the last
+// one is full.
+func (a anyAvailability) Fill(folder string) (fill float64, known bool) {
+	for _, fa := range a {
+		if f, ok := FolderFill(fa, folder); ok && (!known || f < fill) {
+			fill, known = f, true
+		}
+	}
+	return fill, known
+}
+
+func newSubRules(rule fileflows.AvailabilityRule) ([]FolderAvailability, error) {
+	if len(rule.Rules) == 0 {
+		return nil, fmt.Errorf("rule %s needs sub rules", rule.Type)
+	}
+
+	availabilities := make([]FolderAvailability, 0, len(rule.Rules))
+	for _, r := range rule.Rules {
+		fa, err := NewAvailabilityRule(r)
+		if err != nil {
+			return nil, err
+		}
+		availabilities = append(availabilities, fa)
+	}
+	return availabilities, nil
+}
+
+func newFileCountRule(rule fileflows.AvailabilityRule) (FolderAvailability, error) {
+	maxCount, err := rule.Int("max")
+	if err != nil {
+		return nil, err
+	}
+	return ByFileCount{MaxFileCount: int(maxCount)}, nil
+}
+
+func newFolderBytesRule(rule fileflows.AvailabilityRule) (FolderAvailability, error) {
+	maxBytes, err := rule.Int("max")
+	if err != nil {
+		return nil, err
+	}
+	return ByFolderBytes{MaxBytes: maxBytes}, nil
+}
+
+func newFileSizeRule(rule fileflows.AvailabilityRule) (FolderAvailability, error) {
+	minSize, err := rule.Int("min")
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := rule.Int("max")
+	if err != nil {
+		return nil, err
+	}
+	return ByFileSize{MinSize: minSize, MaxSize: maxSize}, nil
+}
+
+func newFreeSpaceRule(rule fileflows.AvailabilityRule) (FolderAvailability, error) {
+	reserve, err := rule.Int("reserve")
+	if err != nil {
+		return nil, err
+	}
+	return ByFreeSpace{Reserve: reserve}, nil
+}
+
+func newPauseFileRule(rule fileflows.AvailabilityRule) (FolderAvailability, error) {
+	name := rule.Params["name"]
+	if name == "" {
+		name = "PAUSE"
+	}
+	return ByPauseFile{Name: name}, nil
+}
+
+func newTimeWindowRule(rule fileflows.AvailabilityRule) (FolderAvailability, error) {
+	from, err := fileflows.ParseTimeOfDay(rule.Params["from"])
+	if err != nil {
+		return nil, fmt.Errorf("parameter from of rule %s: %w", rule.Type, err)
+	}
+	to, err := fileflows.ParseTimeOfDay(rule.Params["to"])
+	if err != nil {
+		return nil, fmt.Errorf("parameter to of rule %s: %w", rule.Type, err)
+	}
+	return ByTimeWindow{From: from, To: to}, nil
+}
@@ -0,0 +1,305 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"FileFlow/files"
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAvailabilityByFolderBytes(t *testing.T) {
+	// Given
+	folder := t.TempDir()
+	createFile(t, folder, "file_A") // 21 bytes
+	incoming := fileInfo(t, createFile(t, t.TempDir(), "file_B"))
+
+	var tests = []struct {
+		maxBytes  int64
+		available bool
+	}{
+		{0, true},
+		{42, true},
+		{41, false},
+		{21, false},
+	}
+
+	for _, test := range tests {
+		// When
+		fa := ByFolderBytes{MaxBytes: test.maxBytes}
+		available := fa.IsAvailableFor(folder, incoming)
+
+		// Then
+		if available != test.available {
+			t.Errorf("Expected availability %v with max bytes %d, got %v", test.available, test.maxBytes, available)
+		}
+	}
+}
+
+func TestAvailabilityCountsSubfolders(t *testing.T) {
+	// Given
+	folder := t.TempDir()
+	createFile(t, folder, "file_A")
+	createFile(t, folder, "sub/file_B")
+	createFile(t, folder, files.TempFile("sub/file_C"))
+	incoming := fileInfo(t, createFile(t, t.TempDir(), "file_D"))
+
+	// When
+	byCount := ByFileCount{MaxFileCount: 2}.IsAvailable(folder)
+	byBytes := ByFolderBytes{MaxBytes: 63}.IsAvailableFor(folder, incoming)
+
+	// Then
+	if byCount {
+		t.Errorf("Folder holding 2 files in its tree should be full")
+	}
+	if !byBytes {
+		t.Errorf("Folder holding 42 bytes (temporary files excluded) should have room for 21 bytes")
+	}
+}
+
+func TestAvailabilityByFileSize(t *testing.T) {
+	// Given
+	incoming := fileInfo(t, createFile(t, t.TempDir(), "file_A")) // 21 bytes
+
+	var tests = []struct {
+		minSize   int64
+		maxSize   int64
+		available bool
+	}{
+		{0, 0, true},
+		{21, 21, true},
+		{22, 0, false},
+		{0, 20, false},
+	}
+
+	for _, test := range tests {
+		// When
+		fa := ByFileSize{MinSize: test.minSize, MaxSize: test.maxSize}
+		available := fa.IsAvailableFor("/dest", incoming)
+
+		// Then
+		if available != test.available {
+			t.Errorf("Expected availability %v for size in [%d, %d], got %v", test.available, test.minSize, test.maxSize, available)
+		}
+	}
+}
+
+func TestAvailabilityByFreeSpace(t *testing.T) {
+	// Given
+	folder := t.TempDir()
+	free, err := files.FreeSpace(folder)
+	if errors.Is(err, files.ErrFreeSpaceUnsupported) {
+		t.Skip("free space is not supported on this platform")
+	}
+	incoming := fileInfo(t, createFile(t, t.TempDir(), "file_A")) // 21 bytes
+
+	var tests = []struct {
+		reserve   int64
+		available bool
+	}{
+		{0, true},
+		{free / 2, true},
+		{free * 2, false},
+	}
+
+	for _, test := range tests {
+		// When
+		fa := ByFreeSpace{Reserve: test.reserve}
+		available := fa.IsAvailableFor(folder, incoming)
+
+		// Then
+		if available != test.available {
+			t.Errorf("Expected availability %v with reserve %d, got %v", test.available, test.reserve, available)
+		}
+	}
+
+	if (ByFreeSpace{Ratio: float64(free) / 10}).IsAvailableFor(folder, incoming) {
+		t.Errorf("Expected no room for a file growing to %d times its size", free/10)
+	}
+
+	if (ByFreeSpace{}).IsAvailable(folder + "/missing") {
+		t.Errorf("Expected a missing folder to be unavailable")
+	}
+}
+
+func TestDispatchFileChecksAllAvailabilities(t *testing.T) {
+	// Given
+	pattern := ".+"
+	full := t.TempDir()
+	createFile(t, full, "file_A")
+	empty := t.TempDir()
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{full, empty}, Regexp: regexp.MustCompile(pattern), MaxFileCount: 5, MaxFolderBytes: 30}
+	incoming := fileInfo(t, createFile(t, t.TempDir(), "file_B"))
+
+	// When
+	fa, err := NewFolderAvailability(&flow)
+	if err != nil {
+		t.Fatalf("Error creating availability: %s", err)
+	}
+	dispatcher := NewDispatcher(&flow, fa, noop)
+	dst, err := dispatcher.DispatchFile(context.Background(), SourceFile{incoming, "file_B"})
+
+	// Then
+	if err != nil {
+		t.Errorf("Error dispatching file: %s", err)
+	}
+
+	if dst != empty+"/file_B" {
+		t.Errorf("Expected destination: %s, got: %s", empty+"/file_B", dst)
+	}
+}
+
+func TestAvailabilityRulesFromConfiguration(t *testing.T) {
+	// Given
+	paused := t.TempDir()
+	createFile(t, paused, "PAUSE")
+	full := t.TempDir()
+	createFile(t, full, "file_A")
+	createFile(t, full, "file_B")
+	pausedAndFull := t.TempDir()
+	createFile(t, pausedAndFull, "PAUSE")
+	createFile(t, pausedAndFull, "file_A")
+	empty := t.TempDir()
+
+	anyRule := fileflows.AvailabilityRule{Type: "any", Rules: []fileflows.AvailabilityRule{
+		{Type: "pause_file"},
+		{Type: "file_count", Params: map[string]string{"max": "2"}},
+	}}
+	allRule := fileflows.AvailabilityRule{Type: "all", Rules: anyRule.Rules}
+	var tests = []struct {
+		rule      fileflows.AvailabilityRule
+		folder    string
+		available bool
+	}{
+		{anyRule, paused, true},
+		{anyRule, full, true},
+		{anyRule, pausedAndFull, false},
+		{anyRule, empty, true},
+		{allRule, paused, false},
+		{allRule, full, false},
+		{allRule, empty, true},
+	}
+
+	for _, test := range tests {
+		// When
+		fa, err := NewAvailabilityRule(test.rule)
+		if err != nil {
+			t.Fatalf("Error creating availability: %s", err)
+		}
+		available := fa.IsAvailable(test.folder)
+
+		// Then
+		if available != test.available {
+			t.Errorf("Expected availability %v for rule %s, got %v", test.available, test.rule.Type, available)
+		}
+	}
+}
+
+func TestAvailabilityRuleErrors(t *testing.T) {
+	var tests = []fileflows.AvailabilityRule{
+		{Type: "unknown"},
+		{Type: "any"},
+		{Type: "file_count", Params: map[string]string{"max": "ten"}},
+		{Type: "time_window", Params: map[string]string{"from": "8h", "to": "18:00"}},
+	}
+
+	for _, rule := range tests {
+		// When
+		_, err := NewAvailabilityRule(rule)
+
+		// Then
+		if err == nil {
+			t.Errorf("Expected error for rule %+v, got nothing", rule)
+		}
+	}
+}
+
+func TestAvailabilityByTimeWindow(t *testing.T) {
+	var tests = []struct {
+		from, to  time.Duration
+		hour      int
+		available bool
+	}{
+		{8 * time.Hour, 18 * time.Hour, 12, true},
+		{8 * time.Hour, 18 * time.Hour, 18, false},
+		{20 * time.Hour, 6 * time.Hour, 23, true},
+		{20 * time.Hour, 6 * time.Hour, 3, true},
+		{20 * time.Hour, 6 * time.Hour, 12, false},
+	}
+
+	for _, test := range tests {
+		// Given
+		now := time.Date(2023, 6, 1, test.hour, 0, 0, 0, time.Local)
+		fa := ByTimeWindow{From: test.from, To: test.to, now: func() time.Time { return now }}
+
+		// When
+		available := fa.IsAvailable("/dest")
+
+		// Then
+		if available != test.available {
+			t.Errorf("Expected availability %v at %dh for window %v-%v, got %v", test.available, test.hour, test.from, test.to, available)
+		}
+	}
+}
+
+func TestRegisterAvailability(t *testing.T) {
+	// Given
+	RegisterAvailability("never", func(_ fileflows.AvailabilityRule) (FolderAvailability, error) {
+		return new(mockFolderAvailability), nil
+	})
+	flow := fileflows.FileFlow{Name: "Move ACME files", Availability: &fileflows.AvailabilityRule{Type: "never"}}
+
+	// When
+	fa, err := NewFolderAvailability(&flow)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Error creating availability: %s", err)
+	}
+
+	if fa.IsAvailable("/dest1") {
+		t.Errorf("Expected /dest1 to be unavailable")
+	}
+}
+
+func fileInfo(t *testing.T, filePath string) os.FileInfo {
+	t.Helper()
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestFolderFill(t *testing.T) {
+	// Given
+	folder := t.TempDir()
+	createFile(t, folder, "file_A") // 21 bytes
+	createFile(t, folder, "file_B") // 21 bytes
+
+	var tests = []struct {
+		fa    FolderAvailability
+		fill  float64
+		known bool
+	}{
+		{ByFileCount{MaxFileCount: 4}, 0.5, true},
+		{ByFolderBytes{MaxBytes: 168}, 0.25, true},
+		{ByFileCount{}, 0, false},
+		{ByPauseFile{Name: "PAUSE"}, 0, false},
+		{All(ByFileCount{MaxFileCount: 4}, ByFolderBytes{MaxBytes: 168}, ByPauseFile{Name: "PAUSE"}), 0.5, true},
+		{Any(ByFileCount{MaxFileCount: 4}, ByFolderBytes{MaxBytes: 168}), 0.25, true},
+	}
+
+	for _, test := range tests {
+		// When
+		fill, known := FolderFill(test.fa, folder)
+
+		// Then
+		if fill != test.fill || known != test.known {
+			t.Errorf("Expected fill %v (known %v) with %+v, got %v (known %v)", test.fill, test.known, test.fa, fill, known)
+		}
+	}
+}
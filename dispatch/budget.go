@@ -0,0 +1,77 @@
+package dispatch
+
+import (
+	"sync"
+)
+
+// Budget is the budget of a cycle of a flow: at most maxFiles files and maxBytes bytes dispatched. A zero limit means
+// no limit. Only the dispatched files (delivered or overflowed) use the budget: the files rejected, without available
+// folder or failing don't prevent the next files from being dispatched.
+// A nil Budget has no limit.
+type Budget struct {
+	maxFiles int
+	maxBytes int64
+
+	mu      sync.Mutex
+	settled *sync.Cond
+	files   int
+	bytes   int64
+	pending int
+}
+
+// NewBudget creates the Budget of a cycle. It returns nil when the Budget would never limit anything.
+func NewBudget(maxFiles int, maxBytes int64) *Budget {
+	if maxFiles == 0 && maxBytes == 0 {
+		return nil
+	}
+	b := &Budget{maxFiles: maxFiles, maxBytes: maxBytes}
+	b.settled = sync.NewCond(&b.mu)
+	return b
+}
+
+// Reserve reserves the budget of a file before its dispatch, and returns false when the budget is spent. When the
+// dispatches in progress hold the remaining budget, it waits for their outcome: a file not dispatched gives its
+// budget back. The first file of a cycle always fits, even if it's larger than maxBytes, so that a large file doesn't
+// wait forever.
+// Each reservation is followed by a call to Settle.
+func (b *Budget) Reserve(size int64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.fits(size) {
+		if b.pending == 0 {
+			return false
+		}
+		b.settled.Wait()
+	}
+	b.files++
+	b.bytes += size
+	b.pending++
+	return true
+}
+
+// Settle records the outcome of the dispatch of a reserved file. The budget of a file not dispatched is given back.
+func (b *Budget) Settle(size int64, dispatched bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending--
+	if !dispatched {
+		b.files--
+		b.bytes -= size
+	}
+	b.settled.Broadcast()
+}
+
+func (b *Budget) fits(size int64) bool {
+	if b.maxFiles > 0 && b.files >= b.maxFiles {
+		return false
+	}
+	return b.maxBytes == 0 || b.files == 0 || b.bytes+size <= b.maxBytes
+}
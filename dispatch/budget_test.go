@@ -0,0 +1,90 @@
+package dispatch
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBudget(t *testing.T) {
+	// Given
+	sizes := []int64{30, 10, 20}
+
+	var tests = []struct {
+		maxFiles int
+		maxBytes int64
+		expected int
+	}{
+		{0, 0, 3},
+		{2, 0, 2},
+		{0, 40, 2},
+		{0, 60, 3},
+		{1, 60, 1},
+		{0, 10, 1},
+	}
+
+	for _, test := range tests {
+		// When
+		budget := NewBudget(test.maxFiles, test.maxBytes)
+		reserved := 0
+		for _, size := range sizes {
+			if !budget.Reserve(size) {
+				break
+			}
+			budget.Settle(size, true)
+			reserved++
+		}
+
+		// Then
+		if reserved != test.expected {
+			t.Errorf("Expected %d files with max %d files and %d bytes, got %d", test.expected, test.maxFiles, test.maxBytes, reserved)
+		}
+	}
+}
+
+func TestFailedFilesDontUseTheBudget(t *testing.T) {
+	// Given
+	budget := NewBudget(1, 0)
+
+	// When
+	for i := 0; i < 3; i++ {
+		if !budget.Reserve(10) {
+			t.Fatalf("Budget should be left for file %d", i)
+		}
+		budget.Settle(10, false)
+	}
+	dispatched := budget.Reserve(10)
+	budget.Settle(10, true)
+
+	// Then
+	if !dispatched {
+		t.Errorf("Budget should be left after failed files")
+	}
+	if budget.Reserve(10) {
+		t.Errorf("Budget should be spent")
+	}
+}
+
+func TestReserveWaitsForTheDispatchesInProgress(t *testing.T) {
+	// Given
+	budget := NewBudget(1, 0)
+	if !budget.Reserve(10) {
+		t.Fatalf("Budget should be left")
+	}
+
+	// When
+	reserved := make(chan bool)
+	go func() {
+		reserved <- budget.Reserve(10)
+	}()
+	select {
+	case <-reserved:
+		t.Fatalf("Reserve should wait for the dispatch in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	budget.Settle(10, false)
+
+	// Then
+	if !<-reserved {
+		t.Errorf("Budget of the failed file should be given back")
+	}
+}
@@ -0,0 +1,67 @@
+package dispatch
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+)
+
+// digestKey is the context key of the digest of a transfer.
+type digestKey struct{}
+
+// digest receives the SHA-256 hash of the file delivered by a transfer. The processors compute it while they write
+// the file, so that the delivered file isn't read again.
+type digest struct {
+	sum string
+}
+
+// withDigest returns a context asking the processors for the digest of the transfer, and the digest they fill.
+func withDigest(ctx context.Context) (context.Context, *digest) {
+	d := &digest{}
+	return context.WithValue(ctx, digestKey{}, d), d
+}
+
+// Sum returns the hexadecimal hash of the delivered file, empty when it's unknown.
+func (d *digest) Sum() string {
+	if d == nil {
+		return ""
+	}
+	return d.sum
+}
+
+// digestWriter returns the writer of the delivered file, hashing the written bytes when the context asks for the
+// digest of the transfer. done records the hash into the digest once the file is completely written.
+func digestWriter(ctx context.Context, w io.Writer) (writer io.Writer, done func()) {
+	d, _ := ctx.Value(digestKey{}).(*digest)
+	if d == nil {
+		return w, func() {}
+	}
+
+	h := sha256.New()
+	return io.MultiWriter(w, h), func() {
+		d.sum = hex.EncodeToString(h.Sum(nil))
+	}
+}
+
+// digestFile records the hash of the file into the digest of the transfer, when the context asks for it. It's used
+// for the files that aren't written as a stream (downloaded by chunks or resumed).
+func digestFile(ctx context.Context, name string) error {
+	if ctx.Value(digestKey{}) == nil {
+		return nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, done := digestWriter(ctx, io.Discard)
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+	done()
+	return nil
+}
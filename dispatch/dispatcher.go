@@ -2,18 +2,44 @@
 package dispatch
 
 import (
+	"FileFlow/audit"
 	"FileFlow/fileflows"
 	"FileFlow/files"
+	"FileFlow/logging"
+	"FileFlow/metrics"
+	"FileFlow/notify"
+	"FileFlow/tracing"
+	"context"
+	"errors"
 	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Dispatcher contains data and functions for dispatching files into different folders.
 type Dispatcher struct {
 	flow *fileflows.FileFlow
 	FileProcessor
-	dstOffset          int
+	strategy           Strategy
 	folderAvailability FolderAvailability
+	journal            *Journal
+	audit              *audit.Log
+	metrics            *metrics.Metrics
+	notifier           notify.Notifier
+	budget             *Budget
+	waiting            *WaitingFiles
+	logger             *slog.Logger
+
+	// strategyMu serializes the calls to the strategy between the goroutines dispatching files.
+	strategyMu sync.Mutex
 }
 
 // DispatcherError is an error type for managing error while dispatching files.
@@ -25,6 +51,25 @@ func (de DispatcherError) Error() string {
 	return fmt.Sprintf("can't dispatch file %s because there is no available folder", de.source)
 }
 
+// RejectedFileError is the error of a file that no destination folder could ever accept, because of its size for
+// instance. The file is left in the source folder.
+// The reason is the error of the check rejecting the file, nil for the availability rules.
+type RejectedFileError struct {
+	source string
+	reason error
+}
+
+func (re RejectedFileError) Error() string {
+	if re.reason != nil {
+		return fmt.Sprintf("can't dispatch file %s: %v", re.source, re.reason)
+	}
+	return fmt.Sprintf("can't dispatch file %s because the availability rules reject it", re.source)
+}
+
+func (re RejectedFileError) Unwrap() error {
+	return re.reason
+}
+
 // Callback is a function that is called when a destination folder is allocated to a file while dispatching.
 // The src parameter is the absolute source file path name and the dst parameter is the absolute destination file path.
 type Callback func(src string, dst string) error
@@ -35,6 +80,7 @@ type FolderAvailability interface {
 }
 
 // NewDispatcher creates a new Dispatcher instance.
+// The destination folders are used with the round-robin strategy. See WithStrategy to change it.
 // Example:
 //
 //	pattern := ".+"
@@ -49,43 +95,167 @@ type FolderAvailability interface {
 //	dispatcher := NewDispatcher(&flow, mock, callback)
 func NewDispatcher(flow *fileflows.FileFlow, fa FolderAvailability, processor FileProcessor) *Dispatcher {
 	return &Dispatcher{
-		flow,
-		processor,
-		0,
-		fa,
+		flow:               flow,
+		FileProcessor:      processor,
+		strategy:           RoundRobin(),
+		folderAvailability: fa,
+		logger:             logging.ForFlow(flow.Name),
 	}
 }
 
+// Logger returns the logger of the flow of the dispatcher.
+func (d *Dispatcher) Logger() *slog.Logger {
+	return d.logger
+}
+
+// WithStrategy sets the Strategy choosing the destination folders of the files.
+// As a Strategy may keep a state, the same one should be given to all the dispatchers of a flow. The dispatchers
+// sharing a Strategy must not dispatch files at the same time.
+func (d *Dispatcher) WithStrategy(strategy Strategy) *Dispatcher {
+	d.strategy = strategy
+	return d
+}
+
+// WithJournal sets the Journal of the deliveries of the overflowed files drained by DrainOverflow.
+// The journal of the other deliveries is the one of the FileProcessor, it should be the same: a file whose delivery
+// isn't completed in the journal is not dispatched again.
+func (d *Dispatcher) WithJournal(journal *Journal) *Dispatcher {
+	d.journal = journal
+	return d
+}
+
+// WithAudit sets the audit journal recording the outcome of the transfers.
+func (d *Dispatcher) WithAudit(log *audit.Log) *Dispatcher {
+	d.audit = log
+	return d
+}
+
+// WithMetrics sets the metrics measuring the transfers.
+func (d *Dispatcher) WithMetrics(m *metrics.Metrics) *Dispatcher {
+	d.metrics = m
+	return d
+}
+
+// WithNotifier sets the notifier of the deliveries, the failures and the overflows of the files.
+func (d *Dispatcher) WithNotifier(notifier notify.Notifier) *Dispatcher {
+	d.notifier = notifier
+	return d
+}
+
+// WithBudget sets the Budget of the cycle, used by the overflowed files drained by DrainOverflow.
+// The other files reserve their budget before calling DispatchFile.
+func (d *Dispatcher) WithBudget(budget *Budget) *Dispatcher {
+	d.budget = budget
+	return d
+}
+
+// WithWaiting sets the files of the flow waiting in the source folder, so that they are reported (audited, measured)
+// once while they wait and not at each cycle.
+func (d *Dispatcher) WithWaiting(waiting *WaitingFiles) *Dispatcher {
+	d.waiting = waiting
+	return d
+}
+
 // Dispatch method dispatches a file into a destination folder.
 // This method searches a available folder (using FolderAvailability interface) for the fileName file.
-// The src parameter is not an absolute file path but really the file name. The source folder is set in the flow field
-// of the Dispatcher instance. When a folder is found, then the callback function is called.
+// The fileName parameter is not an absolute file path but the file path relative to the source folder. The source
+// folder is set in the flow field of the Dispatcher instance. When a folder is found, then the file is processed.
+// The relative folder tree is kept in the destination only if the flow preserves it.
 // If the dispatch is successful, then the dst parameter is set to the absolute destination file path and err is nil.
 // If any error occurs, then the dst parameter is set to an empty string and err is set.
-func (d *Dispatcher) Dispatch(fileName string) (dst string, err error) {
-	start := d.dstOffset
+//
+// As the file information is unknown, the FileAvailability checks are not done. Use DispatchFile when possible.
+func (d *Dispatcher) Dispatch(ctx context.Context, fileName string) (dst string, err error) {
+	return d.DispatchFile(ctx, SourceFile{Path: fileName})
+}
 
-	for {
-		dst, err := d.tryDispatch(fileName)
-		if err != nil {
-			return "", err
+// DispatchFile dispatches a file found in the source folder into a destination folder.
+// It works like Dispatch but the folder availability can also depend on the file (its size for instance).
+// DispatchFile may be called by many goroutines at the same time. The dispatch is traced as a span of the context.
+func (d *Dispatcher) DispatchFile(ctx context.Context, file SourceFile) (dst string, err error) {
+	ctx, span := tracing.Tracer().Start(ctx, "dispatch", trace.WithAttributes(
+		tracing.FlowKey.String(d.flow.Name),
+		tracing.FileKey.String(file.Path),
+		tracing.SizeKey.Int64(fileSize(file.FileInfo)),
+		tracing.OperationKey.String(d.flow.Operation.String())))
+	result := audit.Failed
+	defer func() {
+		if err != nil && !IsNotDispatched(err) {
+			result = audit.Failed
 		}
+		span.SetAttributes(tracing.ResultKey.String(result), tracing.DestinationKey.String(dst))
+		tracing.End(span, err)
+	}()
 
-		if dst != "" {
-			return dst, nil
-		}
+	src := ConcatFolderWithFile(d.flow.SourceFolder, file.Path)
+	start := time.Now()
+	if !accepts(d.folderAvailability, file.FileInfo) {
+		err, result = RejectedFileError{file.Path, nil}, audit.Rejected
+		d.reportWaiting(file, src, result, start, err)
+		return "", err
+	}
+	// A file the operation can't process would fail in the overflow folder too, holding up the draining.
+	if reason := checkOperation(file.Path, d.flow.Operation); reason != nil {
+		err, result = RejectedFileError{file.Path, reason}, audit.Rejected
+		d.reportWaiting(file, src, result, start, err)
+		return "", err
+	}
 
-		d.dstOffset++
-		if d.dstOffset >= len(d.flow.DestinationFolders) {
-			d.dstOffset = 0
-		}
+	// The file is delivered but couldn't be removed: its delivery is completed by the journal.
+	if d.journal.pending(src) {
+		err, result = RejectedFileError{file.Path, errors.New("its delivery is not completed")}, audit.Rejected
+		d.reportWaiting(file, src, result, start, err)
+		return "", err
+	}
 
-		if d.dstOffset == start {
-			return "", DispatcherError{fileName}
+	folder, overflowFolder, release := d.selectFolder(file)
+	defer release()
+	if folder != "" || overflowFolder != "" {
+		d.waiting.done(file.Path)
+	}
+
+	ctx, digest := d.withDigest(ctx)
+	switch {
+	case folder != "":
+		result = audit.Delivered
+		dst, err = d.process(ctx, file, folder)
+		d.report(src, fileSize(file.FileInfo), deliveredFile(dst, d.flow.Operation), audit.Delivered, digest.Sum(),
+			start, err)
+		return dst, err
+	case overflowFolder != "":
+		// The overflow starts with the first file of the folder, reserved by this dispatch only.
+		pendingFiles, _ := inflight.pending(overflowFolder)
+		started := pendingFiles == 1 && !files.ContainsFiles(overflowFolder)
+		result = audit.Overflowed
+		dst, err = d.overflow(ctx, file, overflowFolder)
+		d.report(src, fileSize(file.FileInfo), dst, audit.Overflowed, digest.Sum(), start, err)
+		if err == nil && started {
+			d.notify(notify.Event{Type: notify.OverflowStarted, Source: src, Destination: dst, Folder: overflowFolder})
 		}
+		return dst, err
+	}
+
+	err, result = DispatcherError{file.Path}, audit.Deferred
+	d.reportWaiting(file, src, result, start, err)
+	return "", err
+}
+
+// reportWaiting reports the file left in the source folder without transfer, with the result (deferred or
+// rejected). While the file waits for the same reason, it's reported once and not at each cycle.
+func (d *Dispatcher) reportWaiting(file SourceFile, src string, result string, start time.Time, err error) {
+	if d.waiting.wait(file.Path, result) {
+		d.report(src, fileSize(file.FileInfo), "", result, "", start, err)
 	}
 }
 
+// IsNotDispatched tells if the error is the one of a file left in the source folder without any transfer: no folder
+// is available for it (DispatcherError) or it's rejected (RejectedFileError).
+func IsNotDispatched(err error) bool {
+	var dispatcherError DispatcherError
+	var rejectedError RejectedFileError
+	return errors.As(err, &dispatcherError) || errors.As(err, &rejectedError)
+}
+
 // ConcatFolderWithFile is an utility function that concatenates a folder and a file name.
 // It works only for Linux style file path.
 func ConcatFolderWithFile(folder string, fileName string) string {
@@ -95,39 +265,259 @@ func ConcatFolderWithFile(folder string, fileName string) string {
 	return folder + "/" + fileName
 }
 
-func (d *Dispatcher) tryDispatch(fileName string) (string, error) {
-	src := ConcatFolderWithFile(d.flow.SourceFolder, fileName)
+// selectFolder chooses the destination folder of the file or, if all the destination folders are full, the overflow
+// folder. Both are empty when the file can't be dispatched. The file must be accepted by the availability rules, so
+// that an overflowed file can always be drained once its destination folders are emptied.
+// A destination folder isn't available while its overflow folder holds files, so that the overflowed files are
+// delivered first. When the flow resumes its transfers, a folder holding a partial transfer of the file is preferred.
+// The chosen folder is reserved for the file until release is called.
+func (d *Dispatcher) selectFolder(file SourceFile) (folder string, overflowFolder string, release func()) {
+	candidates := d.candidates(file, d.flow.DestinationFolders)
+	if resumes(d.flow) {
+		candidates = d.partialFirst(file, candidates)
+	}
+	for _, folder := range candidates {
+		if release, ok := d.reserveIfAvailable(file, folder, d.flow.OverflowFolderOf(folder)); ok {
+			d.dispatched(file, folder)
+			return folder, "", release
+		}
+	}
 
-	folder := d.flow.DestinationFolders[d.dstOffset]
-	if overflowFolderIsEmpty(d.flow.OverflowFolder) && d.folderAvailability.IsAvailable(folder) {
-		dst := ConcatFolderWithFile(folder, fileName)
-		if err := d.ProcessFile(src, dst, d.flow.Operation); err != nil {
-			return "", err
+	for _, folder := range candidates {
+		if overflowFolder := d.flow.OverflowFolderOf(folder); overflowFolder != "" {
+			return "", overflowFolder, inflight.reserve(overflowFolder, fileSize(file.FileInfo))
 		}
+	}
 
-		d.dstOffset++
-		if d.dstOffset >= len(d.flow.DestinationFolders) {
-			d.dstOffset = 0
+	return "", "", func() {}
+}
+
+// reserveIfAvailable reserves the folder for the file if it's available and if the overflow folder (when not empty)
+// holds no file. The folders are measured without lock, so that the dispatch of the other files isn't held up by
+// the walks of the folders: they are measured again when another file is reserved into them meanwhile.
+func (d *Dispatcher) reserveIfAvailable(file SourceFile, folder string, overflowFolder string) (release func(),
+	ok bool) {
+	measured := []string{folder}
+	if overflowFolder != "" {
+		measured = append(measured, overflowFolder)
+	}
+
+	for {
+		version := inflight.version(measured...)
+		if !overflowFolderIsEmpty(overflowFolder) || !isAvailable(d.folderAvailability, folder, file.FileInfo) {
+			return nil, false
+		}
+		if release, ok := inflight.reserveAt(version, measured, folder, fileSize(file.FileInfo)); ok {
+			return release, true
 		}
+	}
+}
+
+// candidates returns the destination folders the strategy proposes for the file, by order of preference.
+func (d *Dispatcher) candidates(file SourceFile, folders []string) []string {
+	d.strategyMu.Lock()
+	defer d.strategyMu.Unlock()
+	return d.strategy.Candidates(file, folders)
+}
+
+// dispatched tells the strategy the folder is chosen for the file.
+func (d *Dispatcher) dispatched(file SourceFile, folder string) {
+	d.strategyMu.Lock()
+	defer d.strategyMu.Unlock()
+	d.strategy.Dispatched(file, folder)
+}
+
+// process processes the file into the destination folder.
+func (d *Dispatcher) process(ctx context.Context, file SourceFile, folder string) (string, error) {
+	src := ConcatFolderWithFile(d.flow.SourceFolder, file.Path)
+	dst, err := d.destination(folder, file.Path)
+	if err != nil {
+		return "", err
+	}
+	// A file with the same name, from another subfolder, would be replaced: the delivery would fail once transferred.
+	if delivered := deliveredFile(dst, d.flow.Operation); !d.flow.PreserveTree {
+		if _, err := os.Stat(delivered); err == nil {
+			return "", existingFile(delivered)
+		}
+	}
+	if err := d.processFile(ctx, d.FileProcessor, src, dst); err != nil {
+		return "", err
+	}
+
+	return dst, nil
+}
 
+// processFile processes the source file into dst with the processor. The processing is traced as a span of the
+// context, and aborted when the context is done.
+func (d *Dispatcher) processFile(ctx context.Context, processor FileProcessor, src string, dst string) error {
+	_, span := tracing.Tracer().Start(ctx, "process_file", trace.WithAttributes(
+		tracing.FlowKey.String(d.flow.Name),
+		tracing.FileKey.String(src),
+		tracing.DestinationKey.String(dst),
+		tracing.OperationKey.String(d.flow.Operation.String())))
+	err := aborted(ctx, processor.ProcessFile(ctx, src, dst, d.flow.Operation))
+	tracing.End(span, err)
+	return err
+}
+
+// overflow moves the file into the overflow folder. The move is aborted when the context is done.
+func (d *Dispatcher) overflow(ctx context.Context, file SourceFile, overflowFolder string) (string, error) {
+	src := ConcatFolderWithFile(d.flow.SourceFolder, file.Path)
+	dst, err := d.destination(overflowFolder, file.Path)
+	if err != nil {
+		return "", err
+	}
+
+	dst, err = d.OverflowFile(ctx, src, path.Dir(dst))
+	if err = aborted(ctx, err); err != nil {
+		return "", fmt.Errorf("move to overflow folder: %w failed", err)
+	}
+
+	return dst, nil
+}
+
+// destination returns the path of the file into the folder.
+// When the flow preserves the source tree, the subfolders of the file are created into the folder if needed.
+func (d *Dispatcher) destination(folder string, fileName string) (string, error) {
+	dst := ConcatFolderWithFile(folder, targetPath(d.flow, fileName))
+	if !d.flow.PreserveTree {
 		return dst, nil
 	}
 
-	if d.flow.OverflowFolder != "" {
-		dst, err := d.OverflowFile(src, d.flow.OverflowFolder)
-		if err != nil {
-			return "", fmt.Errorf("move to overflow folder: %w failed", err)
+	if dir := path.Dir(fileName); dir != "." {
+		if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+			return "", fmt.Errorf("cannot create folder %s: %w", path.Dir(dst), err)
 		}
+	}
+	return dst, nil
+}
 
-		return dst, nil
+// partialFirst moves the first folder holding a temporary file of the file to the front of the candidates.
+func (d *Dispatcher) partialFirst(file SourceFile, candidates []string) []string {
+	for i, folder := range candidates {
+		tmp := files.TempFile(ConcatFolderWithFile(folder, targetPath(d.flow, file.Path)))
+		if _, err := os.Stat(tmp); err == nil {
+			sorted := append([]string{folder}, candidates[:i]...)
+			return append(sorted, candidates[i+1:]...)
+		}
+	}
+	return candidates
+}
+
+// report measures the outcome of the transfer of the source file, notifies it and writes it into the audit journal,
+// if any. hash is the SHA-256 hash of the delivered file, computed during the transfer.
+func (d *Dispatcher) report(src string, size int64, delivered string, result string, hash string, start time.Time,
+	err error) {
+	duration := time.Since(start)
+	switch {
+	case err != nil:
+		d.metrics.Failed(d.flow.Name, errorType(err))
+	case result == audit.Overflowed:
+		d.metrics.Overflowed(d.flow.Name, duration)
+	default:
+		d.metrics.Transferred(d.flow.Name, d.flow.Operation.String(), size, duration)
+	}
+
+	// The files that can't be dispatched stay in the source folder and are tried again at each cycle: they aren't
+	// notified one by one, the flow notifies its full destination folders.
+	switch {
+	case err != nil && !IsNotDispatched(err):
+		d.notify(notify.Event{Type: notify.FileFailed, Source: src, Size: size, Error: err.Error()})
+	case err == nil && result == audit.Delivered:
+		d.notify(notify.Event{Type: notify.FileDelivered, Source: src, Destination: delivered, Size: size})
+	}
+
+	if d.audit == nil {
+		return
 	}
 
-	return "", nil
+	record := audit.Record{
+		Time:      time.Now(),
+		Flow:      d.flow.Name,
+		Source:    src,
+		Size:      size,
+		Operation: d.flow.Operation.String(),
+		Duration:  duration,
+		Result:    result,
+	}
+	if err != nil {
+		if !IsNotDispatched(err) {
+			record.Result = audit.Failed
+		}
+		record.Error = err.Error()
+	} else {
+		record.Destination = delivered
+		record.Hash = hash
+	}
+
+	if err := d.audit.Write(record); err != nil {
+		d.logger.Warn("Cannot audit transfer", "file", src, "error", err)
+	}
+}
+
+// withDigest returns a context asking the processors for the digest of the delivered file when the transfers are
+// audited. The digest is nil otherwise.
+func (d *Dispatcher) withDigest(ctx context.Context) (context.Context, *digest) {
+	if d.audit == nil {
+		return ctx, nil
+	}
+	return withDigest(ctx)
+}
+
+// notify notifies the event of the flow, if the dispatcher has a notifier.
+func (d *Dispatcher) notify(e notify.Event) {
+	if d.notifier == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Flow = d.flow.Name
+	d.notifier.Notify(e)
+}
+
+// errorType classifies the dispatch errors for the metrics.
+func errorType(err error) string {
+	var dispatcherError DispatcherError
+	var rejectedError RejectedFileError
+	var contentError ContentError
+	var netError net.Error
+	switch {
+	case errors.As(err, &dispatcherError):
+		return "no_available_folder"
+	case errors.As(err, &rejectedError):
+		return "rejected"
+	case errors.As(err, &contentError):
+		return "content"
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return "canceled"
+	case errors.Is(err, fs.ErrExist):
+		return "exists"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not_found"
+	case errors.Is(err, fs.ErrPermission):
+		return "permission"
+	case errors.Is(err, syscall.ENOSPC):
+		return "no_space"
+	case errors.As(err, &netError):
+		return "network"
+	}
+	return "other"
+}
+
+// aborted returns the error of a transfer, wrapping the error of the context when the transfer failed because the
+// context is done.
+func aborted(ctx context.Context, err error) error {
+	if err == nil || ctx.Err() == nil || errors.Is(err, ctx.Err()) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ctx.Err(), err)
 }
 
 func overflowFolderIsEmpty(folder string) bool {
 	if folder == "" {
 		return true
 	}
-	return files.CountFiles(folder) == 0
+	if pendingFiles, _ := inflight.pending(folder); pendingFiles > 0 {
+		return false
+	}
+	return !files.ContainsFiles(folder)
 }
@@ -1,11 +1,29 @@
 package dispatch
 
 import (
+	"FileFlow/audit"
 	"FileFlow/fileflows"
+	"FileFlow/files"
+	"FileFlow/notify"
+	"FileFlow/throttle"
+	"FileFlow/tracing"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io/fs"
+	"log/slog"
 	"os"
+	"path"
 	"regexp"
+	"sync"
 	"testing"
+	"time"
 )
 
 var noop = noopFileProcessor{}
@@ -38,7 +56,7 @@ func TestDispatchOneFileIntoOneDestination(t *testing.T) {
 	// When
 	for _, test := range tests {
 		dispatcher := NewDispatcher(&test.flow, test.fa, noop)
-		dst, err := dispatcher.Dispatch("file_A")
+		dst, err := dispatcher.Dispatch(context.Background(), "file_A")
 
 		// Then
 		if err != nil {
@@ -60,8 +78,8 @@ func TestDispatchTwoFilesIntoManyDestinations(t *testing.T) {
 
 	// When
 	dispatcher := NewDispatcher(&flow, mock, noop)
-	dst, err := dispatcher.Dispatch("file_A")
-	dst2, err2 := dispatcher.Dispatch("file_B")
+	dst, err := dispatcher.Dispatch(context.Background(), "file_A")
+	dst2, err2 := dispatcher.Dispatch(context.Background(), "file_B")
 
 	// Then
 	if err != nil || err2 != nil {
@@ -85,7 +103,7 @@ func TestNoDestinationIsAvailable(t *testing.T) {
 	// When
 	var mock FolderAvailability = new(mockFolderAvailability)
 	dispatcher := NewDispatcher(&flow, mock, noop)
-	_, err := dispatcher.Dispatch("file_A")
+	_, err := dispatcher.Dispatch(context.Background(), "file_A")
 
 	// Then
 	if err == nil {
@@ -97,6 +115,253 @@ func TestNoDestinationIsAvailable(t *testing.T) {
 	}
 }
 
+func TestDispatchPreservesSourceTree(t *testing.T) {
+	// Given
+	pattern := ".+"
+	dest := t.TempDir()
+	var tests = []struct {
+		preserveTree bool
+		dst          string
+	}{
+		{false, dest + "/file_A"},
+		{true, dest + "/sub/dir/file_A"},
+	}
+
+	for _, test := range tests {
+		flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern), PreserveTree: test.preserveTree}
+
+		// When
+		dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), noop)
+		dst, err := dispatcher.Dispatch(context.Background(), "sub/dir/file_A")
+
+		// Then
+		if err != nil {
+			t.Errorf("Error dispatching file: %s", err)
+		}
+
+		if dst != test.dst {
+			t.Errorf("Expected destination: %s, got: %s", test.dst, dst)
+		}
+	}
+
+	if _, err := os.Stat(dest + "/sub/dir"); err != nil {
+		t.Errorf("Folder should be created: %s", dest+"/sub/dir")
+	}
+}
+
+func TestFlattenedFileDoesNotReplaceFileWithTheSameName(t *testing.T) {
+	// Given
+	pattern := ".+"
+	source := t.TempDir()
+	dest := t.TempDir()
+	createFile(t, source, "a/file_A")
+	if err := os.WriteFile(createFile(t, source, "b/file_A"), []byte("Another test file.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: source, Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern)}
+	processor := Open(flow)
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), processor)
+
+	// When
+	var errs []error
+	for _, file := range processor.ListFiles(flow) {
+		_, err := dispatcher.DispatchFile(context.Background(), file)
+		errs = append(errs, err)
+	}
+
+	// Then
+	if len(errs) != 2 || errs[0] != nil {
+		t.Fatalf("Expected a/file_A to be delivered, got %v", errs)
+	}
+
+	if !errors.Is(errs[1], fs.ErrExist) {
+		t.Errorf("Expected b/file_A to fail as file_A is already delivered, got %v", errs[1])
+	}
+
+	if content, err := os.ReadFile(dest + "/file_A"); err != nil || string(content) != "This is a test file.\n" {
+		t.Errorf("Expected delivered a/file_A to be kept, got %q (%v)", content, err)
+	}
+
+	if _, err := os.Stat(source + "/b/file_A"); err != nil {
+		t.Errorf("Expected b/file_A to stay in the source folder: %s", err)
+	}
+}
+
+func TestUncompletedDeliveryIsNotDispatchedAgain(t *testing.T) {
+	// Given
+	pattern := ".+"
+	source := t.TempDir()
+	dest := t.TempDir()
+	src := createFile(t, source, "file_A")
+	journal, err := OpenJournal(t.TempDir()+"/acme.journal", slog.Default())
+	if err != nil {
+		t.Fatalf("Error opening journal: %s", err)
+	}
+	defer journal.Close()
+	// file_A is delivered but its source couldn't be removed.
+	if _, err := journal.begin(src, files.TempFile(dest+"/file_A"), dest+"/file_A", false); err != nil {
+		t.Fatal(err)
+	}
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: source, Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern), PreserveTree: true}
+	processor := Open(flow).Journaled(journal)
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), processor).WithJournal(journal)
+	_, err = dispatcher.Dispatch(context.Background(), "file_A")
+
+	// Then
+	if !errors.As(err, &RejectedFileError{}) {
+		t.Errorf("Expected RejectedFileError, got: %v", err)
+	}
+
+	if _, err := os.Stat(dest + "/file_A"); !os.IsNotExist(err) {
+		t.Errorf("File should not be delivered again: %s", dest+"/file_A")
+	}
+}
+
+func TestOverflowOnlyWhenAllDestinationsAreFull(t *testing.T) {
+	// Given
+	pattern := ".+"
+	overflow := t.TempDir()
+	var tests = []struct {
+		fa  FolderAvailability
+		dst string
+	}{
+		{new(mockFolderAvailability), "/dest2/file_A"},
+		{mockFullFolderAvailability{}, overflow + "/file_A"},
+	}
+
+	for _, test := range tests {
+		flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/dest1", "/dest2"}, Regexp: regexp.MustCompile(pattern), OverflowFolder: overflow}
+
+		// When
+		dispatcher := NewDispatcher(&flow, test.fa, overflowRecorder{})
+		dst, err := dispatcher.Dispatch(context.Background(), "file_A")
+
+		// Then
+		if err != nil {
+			t.Errorf("Error dispatching file: %s", err)
+		}
+
+		if dst != test.dst {
+			t.Errorf("Expected destination: %s, got: %s", test.dst, dst)
+		}
+	}
+}
+
+func TestOverflowFolderPerDestination(t *testing.T) {
+	// Given
+	pattern := ".+"
+	overflow1 := t.TempDir()
+	overflow2 := t.TempDir()
+	createFile(t, overflow1, "file_0")
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/dest1", "/dest2"}, Regexp: regexp.MustCompile(pattern), OverflowFolders: []string{overflow1, overflow2}}
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), overflowRecorder{})
+	dst, err := dispatcher.Dispatch(context.Background(), "file_A")
+	dispatcher = NewDispatcher(&flow, mockFullFolderAvailability{}, overflowRecorder{})
+	dst2, err2 := dispatcher.Dispatch(context.Background(), "file_B")
+
+	// Then
+	if err != nil || err2 != nil {
+		t.Errorf("Error dispatching file: %v %v", err, err2)
+	}
+
+	if dst != "/dest2/file_A" {
+		t.Errorf("Expected destination: %s, got: %s", "/dest2/file_A", dst)
+	}
+
+	if dst2 != overflow1+"/file_B" {
+		t.Errorf("Expected destination: %s, got: %s", overflow1+"/file_B", dst2)
+	}
+}
+
+func TestStaleTempFileDoesNotHoldUpDestinations(t *testing.T) {
+	// Given
+	pattern := ".+"
+	overflow := t.TempDir()
+	createFile(t, overflow, files.TempFile("file_0"))
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/dest1"}, Regexp: regexp.MustCompile(pattern), OverflowFolder: overflow}
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), overflowRecorder{})
+	dst, err := dispatcher.Dispatch(context.Background(), "file_A")
+
+	// Then
+	if err != nil {
+		t.Errorf("Error dispatching file: %s", err)
+	}
+
+	if dst != "/dest1/file_A" {
+		t.Errorf("Expected destination: %s, got: %s", "/dest1/file_A", dst)
+	}
+}
+
+func TestSlowFolderDoesNotHoldUpOtherFlows(t *testing.T) {
+	// Given
+	pattern := ".+"
+	slow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/slow"}, Regexp: regexp.MustCompile(pattern)}
+	fast := fileflows.FileFlow{Name: "Move Wayne files", SourceFolder: "wayne", Pattern: pattern, DestinationFolders: []string{"/fast"}, Regexp: regexp.MustCompile(pattern)}
+	fa := blockingFolderAvailability{folder: "/slow", measuring: make(chan struct{}), done: make(chan struct{})}
+	defer close(fa.done)
+
+	// When
+	go func() {
+		_, _ = NewDispatcher(&slow, fa, overflowRecorder{}).Dispatch(context.Background(), "file_A")
+	}()
+	<-fa.measuring
+	dispatched := make(chan string)
+	go func() {
+		dst, _ := NewDispatcher(&fast, fa, overflowRecorder{}).Dispatch(context.Background(), "file_B")
+		dispatched <- dst
+	}()
+
+	// Then
+	select {
+	case dst := <-dispatched:
+		if dst != "/fast/file_B" {
+			t.Errorf("Expected destination: %s, got: %s", "/fast/file_B", dst)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Dispatch should not wait for the measure of another folder")
+	}
+}
+
+func TestConcurrentDispatchKeepsCapacity(t *testing.T) {
+	// Given
+	pattern := ".+"
+	dest := t.TempDir()
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern), MaxFileCount: 3}
+	dispatcher := NewDispatcher(&flow, ByFileCount{MaxFileCount: flow.MaxFileCount}, slowFileProcessor{})
+
+	// When
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	dispatched := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := dispatcher.Dispatch(context.Background(), fmt.Sprintf("file_%d", i)); err == nil {
+				mu.Lock()
+				dispatched++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Then
+	if dispatched != 3 {
+		t.Errorf("Expected 3 dispatched files, got %d", dispatched)
+	}
+
+	if count := files.CountFiles(dest); count != 3 {
+		t.Errorf("Expected 3 files in %s, got %d", dest, count)
+	}
+}
+
 type mockAlwaysTrueFolderAvailability struct{}
 type mockFolderAvailability struct{}
 
@@ -108,16 +373,269 @@ func (m *mockAlwaysTrueFolderAvailability) IsAvailable(_ string) bool {
 	return true
 }
 
+type mockFullFolderAvailability struct{}
+
+func (m mockFullFolderAvailability) IsAvailable(_ string) bool {
+	return false
+}
+
 type noopFileProcessor struct{}
 
-func (n noopFileProcessor) ProcessFile(_, _ string, _ fileflows.FlowOperation) error {
+func (n noopFileProcessor) ProcessFile(_ context.Context, _, _ string, _ fileflows.FlowOperation) error {
 	return nil
 }
 
-func (n noopFileProcessor) OverflowFile(_, _ string) (dst string, err error) {
+func (n noopFileProcessor) OverflowFile(_ context.Context, _, _ string) (dst string, err error) {
 	return "/", nil
 }
 
 func (n noopFileProcessor) ListFiles(_ fileflows.FileFlow) FileList {
-	return []os.FileInfo{}
+	return FileList{}
+}
+
+// overflowRecorder is a noopFileProcessor whose overflowed files are put into the overflow folder.
+// blockingFolderAvailability takes forever to measure the folder, until done is closed.
+type blockingFolderAvailability struct {
+	folder    string
+	measuring chan struct{}
+	done      chan struct{}
+}
+
+func (b blockingFolderAvailability) IsAvailable(folder string) bool {
+	if folder == b.folder {
+		close(b.measuring)
+		<-b.done
+	}
+	return true
+}
+
+type overflowRecorder struct {
+	noopFileProcessor
+}
+
+func (o overflowRecorder) OverflowFile(_ context.Context, src, overflowFolder string) (dst string, err error) {
+	return ConcatFolderWithFile(overflowFolder, path.Base(src)), nil
+}
+
+// slowFileProcessor is a noopFileProcessor whose processing creates the destination file after a while.
+type slowFileProcessor struct {
+	noopFileProcessor
+}
+
+func (s slowFileProcessor) ProcessFile(_ context.Context, _, dst string, _ fileflows.FlowOperation) error {
+	time.Sleep(20 * time.Millisecond)
+	return os.WriteFile(dst, []byte("This is a test file.\n"), 0644)
+}
+
+func TestDispatchIsAudited(t *testing.T) {
+	// Given
+	pattern := ".+"
+	source := t.TempDir()
+	dest := t.TempDir()
+	createFile(t, source, "file_A")
+	journal := t.TempDir() + "/audit.jsonl"
+	auditLog, err := audit.Open(journal, 0, 0)
+	if err != nil {
+		t.Fatalf("Error opening audit journal: %s", err)
+	}
+	defer auditLog.Close()
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: source, Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern), Operation: fileflows.Compression}
+	processor := Open(flow)
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), processor).WithAudit(auditLog)
+	sourceFiles := processor.ListFiles(flow)
+	if _, err := dispatcher.DispatchFile(context.Background(), sourceFiles[0]); err != nil {
+		t.Fatalf("Error dispatching file: %s", err)
+	}
+
+	// Then
+	var records []audit.Record
+	if err := audit.Search(journal, audit.Query{}, func(r audit.Record) { records = append(records, r) }); err != nil {
+		t.Fatalf("Error searching audit journal: %s", err)
+	}
+
+	if len(records) != 1 {
+		t.Fatalf("Expected 1 record, got %d", len(records))
+	}
+
+	r := records[0]
+	if r.Flow != flow.Name || r.Source != source+"/file_A" || r.Destination != dest+"/file_A.gz" {
+		t.Errorf("Expected transfer of %s to %s, got %+v", source+"/file_A", dest+"/file_A.gz", r)
+	}
+
+	if r.Result != audit.Delivered || r.Operation != "compression" {
+		t.Errorf("Expected compression delivery, got %+v", r)
+	}
+
+	delivered, err := os.ReadFile(dest + "/file_A.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := sha256.Sum256(delivered); r.Hash != hex.EncodeToString(hash[:]) {
+		t.Errorf("Expected hash of delivered file %x, got %s", hash, r.Hash)
+	}
+}
+
+func TestUnavailableDispatchIsAuditedOnce(t *testing.T) {
+	// Given
+	pattern := ".+"
+	journal := t.TempDir() + "/audit.jsonl"
+	auditLog, err := audit.Open(journal, 0, 0)
+	if err != nil {
+		t.Fatalf("Error opening audit journal: %s", err)
+	}
+	defer auditLog.Close()
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/dest1"}, Regexp: regexp.MustCompile(pattern)}
+	waiting := NewWaitingFiles()
+
+	// When
+	dispatcher := NewDispatcher(&flow, mockFullFolderAvailability{}, noop).WithAudit(auditLog).WithWaiting(waiting)
+	_, err = dispatcher.Dispatch(context.Background(), "file_A")
+	_, _ = dispatcher.Dispatch(context.Background(), "file_A")
+	waiting.Keep(nil)
+	_, _ = dispatcher.Dispatch(context.Background(), "file_A")
+
+	// Then
+	if err == nil {
+		t.Fatalf("Expected dispatch error")
+	}
+	var records []audit.Record
+	if err := audit.Search(journal, audit.Query{}, func(r audit.Record) { records = append(records, r) }); err != nil {
+		t.Fatalf("Error searching audit journal: %s", err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("Expected a record per waiting period, got %+v", records)
+	}
+	if records[0].Result != audit.Deferred || records[0].Error != err.Error() {
+		t.Errorf("Expected deferred dispatch record, got %+v", records[0])
+	}
+}
+
+func TestDispatchIsNotified(t *testing.T) {
+	// Given
+	pattern := ".+"
+	overflow := t.TempDir()
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/dest1"}, Regexp: regexp.MustCompile(pattern), OverflowFolder: overflow}
+	var tests = []struct {
+		fa       FolderAvailability
+		expected notify.Event
+	}{
+		{new(mockAlwaysTrueFolderAvailability), notify.Event{Type: notify.FileDelivered, Flow: flow.Name, Source: "acme/file_A", Destination: "/dest1/file_A"}},
+		{mockFullFolderAvailability{}, notify.Event{Type: notify.OverflowStarted, Flow: flow.Name, Source: "acme/file_A", Destination: overflow + "/file_A", Folder: overflow}},
+	}
+
+	for _, test := range tests {
+		// When
+		recorder := &eventRecorder{}
+		dispatcher := NewDispatcher(&flow, test.fa, overflowRecorder{}).WithNotifier(recorder)
+		if _, err := dispatcher.Dispatch(context.Background(), "file_A"); err != nil {
+			t.Fatalf("Error dispatching file: %s", err)
+		}
+
+		// Then
+		if len(recorder.events) != 1 {
+			t.Fatalf("Expected 1 event, got %+v", recorder.events)
+		}
+		got := recorder.events[0]
+		got.Time = time.Time{}
+		if got != test.expected {
+			t.Errorf("Expected event %+v, got %+v", test.expected, got)
+		}
+	}
+}
+
+func TestUndispatchedFilesAreNotNotified(t *testing.T) {
+	// Given
+	pattern := ".+"
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/dest1"}, Regexp: regexp.MustCompile(pattern), Operation: fileflows.Decompression}
+	recorder := &eventRecorder{}
+	dispatcher := NewDispatcher(&flow, mockFullFolderAvailability{}, overflowRecorder{}).WithNotifier(recorder)
+
+	// When
+	_, errFull := dispatcher.Dispatch(context.Background(), "file_A.gz")
+	_, errRejected := dispatcher.Dispatch(context.Background(), "file_B.csv")
+
+	// Then
+	if !IsNotDispatched(errFull) || !IsNotDispatched(errRejected) {
+		t.Errorf("Expected files not dispatched, got %v and %v", errFull, errRejected)
+	}
+	if len(recorder.events) != 0 {
+		t.Errorf("Expected no event, got %+v", recorder.events)
+	}
+}
+
+type eventRecorder struct {
+	events []notify.Event
+}
+
+func (r *eventRecorder) Notify(e notify.Event) {
+	r.events = append(r.events, e)
+}
+
+func TestDispatchIsTraced(t *testing.T) {
+	// Given
+	pattern := ".+"
+	recorder := tracetest.NewSpanRecorder()
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/dest1"}, Regexp: regexp.MustCompile(pattern)}
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), noop)
+	if _, err := dispatcher.Dispatch(context.Background(), "file_A"); err != nil {
+		t.Fatalf("Error dispatching file: %s", err)
+	}
+
+	// Then
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Name() != "process_file" || spans[1].Name() != "dispatch" {
+		t.Fatalf("Expected process_file and dispatch spans, got %d spans", len(spans))
+	}
+	if spans[0].Parent().SpanID() != spans[1].SpanContext().SpanID() {
+		t.Errorf("Expected process_file span in dispatch span")
+	}
+
+	attributes := make(map[attribute.Key]string)
+	for _, a := range spans[1].Attributes() {
+		attributes[a.Key] = a.Value.Emit()
+	}
+	expected := map[attribute.Key]string{
+		tracing.FlowKey:        "Move ACME files",
+		tracing.FileKey:        "file_A",
+		tracing.OperationKey:   "move",
+		tracing.ResultKey:      audit.Delivered,
+		tracing.DestinationKey: "/dest1/file_A",
+	}
+	for key, value := range expected {
+		if attributes[key] != value {
+			t.Errorf("Expected attribute %s=%s, got %s", key, value, attributes[key])
+		}
+	}
+}
+
+func TestAbortedDispatchLeavesNoPartialFile(t *testing.T) {
+	// Given
+	pattern := ".+"
+	source, dest := t.TempDir(), t.TempDir()
+	src := createFile(t, source, "file_A")
+	flow := fileflows.NewLocalFileFlow("Move ACME files", source, pattern, []string{dest}, fileflows.Move, 0, "")
+	processor := Open(flow).Throttled(throttle.NewLimiter(50, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), processor)
+	_, err := dispatcher.Dispatch(ctx, "file_A")
+
+	// Then
+	if !errors.Is(err, context.DeadlineExceeded) || errorType(err) != "canceled" {
+		t.Fatalf("Expected aborted dispatch, got %v", err)
+	}
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("Expected source file to be kept, got %s", err)
+	}
+	if entries, _ := os.ReadDir(dest); len(entries) != 0 {
+		t.Errorf("Expected no file in destination folder, got %s", entries[0].Name())
+	}
 }
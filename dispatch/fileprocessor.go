@@ -2,12 +2,18 @@ package dispatch
 
 import (
 	"FileFlow/fileflows"
+	"FileFlow/files"
+	"FileFlow/logging"
+	"FileFlow/throttle"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
+	"github.com/kr/fs"
 	"io"
-	"io/fs"
-	"log"
+	"log/slog"
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -20,17 +26,26 @@ type FileProcessor interface {
 	// src parameter is the source full file path
 	// dst parameter is the destination full file path
 	// operation parameter is the operation to do
-	ProcessFile(src, dst string, operation fileflows.FlowOperation) error
+	// The transfer is aborted when the context is done, without leaving a partial file behind.
+	ProcessFile(ctx context.Context, src, dst string, operation fileflows.FlowOperation) error
 
 	// OverflowFile move a file to the overflow directory
 	// src parameter is the full path of the file to move
-	OverflowFile(src, overflowFolder string) (dst string, err error)
+	// The transfer is aborted when the context is done, without leaving a partial file behind.
+	OverflowFile(ctx context.Context, src, overflowFolder string) (dst string, err error)
 
 	// ListFiles list all the files in the flow's source directory
 	ListFiles(flow fileflows.FileFlow) FileList
 }
 
-type FileList []os.FileInfo
+// SourceFile is a file found in the source folder of a flow.
+type SourceFile struct {
+	os.FileInfo
+	// Path is the file path relative to the source folder of the flow.
+	Path string
+}
+
+type FileList []SourceFile
 
 func (fl FileList) Len() int {
 	return len(fl)
@@ -41,60 +56,149 @@ func (fl FileList) Swap(i, j int) {
 }
 
 func (fl FileList) Less(i, j int) bool {
-	return fl[i].Name() < fl[j].Name()
+	return fl[i].Path < fl[j].Path
 }
 
-func uncompressOperation(src, dst string, inp fs.File) error {
-	tmpDst := dst + ".tmp"
-	out, err := os.Create(tmpDst)
-	if err != nil {
-		return err
+// Paths returns the paths of the files, relative to the source folder of the flow.
+func (fl FileList) Paths() []string {
+	paths := make([]string, len(fl))
+	for i, file := range fl {
+		paths[i] = file.Path
 	}
-	defer out.Close()
-	if strings.HasSuffix(src, ".gz") {
-		finalName := strings.Replace(dst, ".gz", "", 1)
-		log.Printf("Decompressing %s to %s", src, finalName)
-		err := uncompressFile(inp, out)
-		if err != nil {
-			return fmt.Errorf("error decompressing file %s to %s: %v", src, tmpDst, err)
+	return paths
+}
+
+// collectFiles walks the source folder of the flow and returns the files matching the flow pattern.
+// The walk stops at the maximum depth of the flow (if any).
+func collectFiles(walker *fs.Walker, flow fileflows.FileFlow) FileList {
+	root := strings.TrimSuffix(flow.SourceFolder, "/")
+	var files = make(FileList, 0, 50)
+	for walker.Step() {
+		if walker.Err() != nil {
+			logging.ForFlow(flow.Name).Warn("Cannot walk folder", "folder", walker.Path(), "error", walker.Err())
+			continue
 		}
-		if err := os.Rename(tmpDst, finalName); err != nil {
-			return fmt.Errorf("error renaming file %s to %s: %v", tmpDst, finalName, err)
+
+		rel := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), root), "/")
+		if rel == "" {
+			continue
 		}
-	} else {
-		_ = os.Remove(tmpDst)
-		return fmt.Errorf("cannot uncompress file %s because it seems to be not compressed", src)
+
+		fileInfo := walker.Stat()
+		depth := strings.Count(rel, "/") + 1
+		if fileInfo.IsDir() {
+			if flow.MaxDepth > 0 && depth >= flow.MaxDepth {
+				walker.SkipDir()
+			}
+			continue
+		}
+
+		if flow.Regexp.MatchString(fileInfo.Name()) {
+			files = append(files, SourceFile{fileInfo, rel})
+		}
+	}
+
+	sort.Sort(files)
+	return files
+}
+
+// deliveredFile returns the name of the file delivered for the destination dst by the operation.
+func deliveredFile(dst string, operation fileflows.FlowOperation) string {
+	switch operation {
+	case fileflows.Compression:
+		return dst + ".gz"
+	case fileflows.Decompression:
+		return strings.Replace(dst, ".gz", "", 1)
 	}
+	return dst
+}
+
+// ContentError is the error of a file whose content can't go through the operation of the flow: a file to decompress
+// that isn't compressed or is corrupted, or a file to compress that is compressed already. Trying again never helps.
+type ContentError struct {
+	source string
+	err    error
+}
+
+func (ce ContentError) Error() string {
+	return fmt.Sprintf("cannot process file %s with the operation of the flow: %v", ce.source, ce.err)
+}
+
+func (ce ContentError) Unwrap() error {
+	return ce.err
+}
 
+// checkOperation returns a ContentError when the name of the file tells it can't go through the operation.
+func checkOperation(src string, operation fileflows.FlowOperation) error {
+	switch {
+	case operation == fileflows.Compression && strings.HasSuffix(src, ".gz"):
+		return ContentError{src, errors.New("it seems to be compressed already")}
+	case operation == fileflows.Decompression && !strings.HasSuffix(src, ".gz"):
+		return ContentError{src, errors.New("it seems to be not compressed")}
+	}
 	return nil
 }
 
-func compressOperation(src, dst string, inp fs.File) error {
-	tmpDst := dst + ".tmp"
+// uncompressOperation decompresses the gzip source into the temporary file of dst, without the .gz extension.
+// It returns the temporary file and the final name of the decompressed file.
+// The SHA-256 hash of the decompressed file is recorded into the digest of the context, if any.
+func uncompressOperation(ctx context.Context, src, dst string, inp io.Reader, logger *slog.Logger) (tmpDst string,
+	finalName string, err error) {
+	if err := checkOperation(src, fileflows.Decompression); err != nil {
+		return "", "", err
+	}
+
+	tmpDst = files.TempFile(dst)
 	out, err := os.Create(tmpDst)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 	defer out.Close()
-	if !strings.HasSuffix(src, ".gz") {
-		gzName := dst + ".gz"
-		log.Printf("Compressing %s to %s", src, gzName)
-		err := compressFile(inp, out)
-		if err != nil {
-			return fmt.Errorf("error compressing file %s to %s: %v", src, tmpDst, err)
-		}
-		if err := os.Rename(tmpDst, gzName); err != nil {
-			return fmt.Errorf("error renaming file %s to %s: %v", tmpDst, gzName, err)
+
+	finalName = deliveredFile(dst, fileflows.Decompression)
+	logger.Info("Decompressing file", "src", src, "dst", finalName)
+	w, digested := digestWriter(ctx, out)
+	if err := uncompressFile(inp, w); err != nil {
+		_ = os.Remove(tmpDst)
+		if errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return "", "", ContentError{src, err}
 		}
-	} else {
+		return "", "", fmt.Errorf("error decompressing file %s to %s: %v", src, tmpDst, err)
+	}
+	digested()
+
+	return tmpDst, finalName, nil
+}
+
+// compressOperation compresses the source into the temporary file of dst, with the .gz extension.
+// It returns the temporary file and the final name of the compressed file.
+// The SHA-256 hash of the compressed file is recorded into the digest of the context, if any.
+func compressOperation(ctx context.Context, src, dst string, inp io.Reader, logger *slog.Logger) (tmpDst string,
+	gzName string, err error) {
+	if err := checkOperation(src, fileflows.Compression); err != nil {
+		return "", "", err
+	}
+
+	tmpDst = files.TempFile(dst)
+	out, err := os.Create(tmpDst)
+	if err != nil {
+		return "", "", err
+	}
+	defer out.Close()
+
+	gzName = deliveredFile(dst, fileflows.Compression)
+	logger.Info("Compressing file", "src", src, "dst", gzName)
+	w, digested := digestWriter(ctx, out)
+	if err := compressFile(inp, w); err != nil {
 		_ = os.Remove(tmpDst)
-		return fmt.Errorf("cannot compress file %s because it seems to be compressed already", src)
+		return "", "", fmt.Errorf("error compressing file %s to %s: %v", src, tmpDst, err)
 	}
+	digested()
 
-	return nil
+	return tmpDst, gzName, nil
 }
 
-func compressFile(inp fs.File, out *os.File) error {
+func compressFile(inp io.Reader, out io.Writer) error {
 	zw := gzip.NewWriter(out)
 	defer zw.Close()
 
@@ -106,7 +210,7 @@ func compressFile(inp fs.File, out *os.File) error {
 	return nil
 }
 
-func uncompressFile(inp fs.File, out *os.File) error {
+func uncompressFile(inp io.Reader, out io.Writer) error {
 	r, err := gzip.NewReader(inp)
 	if err != nil {
 		return err
@@ -120,3 +224,20 @@ func uncompressFile(inp fs.File, out *os.File) error {
 
 	return nil
 }
+
+// abortOnDone closes the input of a transfer as soon as the context is done, so that the copy fails at its next read
+// instead of running to its end. The returned function stops watching the context.
+func abortOnDone(ctx context.Context, inp io.Closer) (stop func() bool) {
+	return context.AfterFunc(ctx, func() { _ = inp.Close() })
+}
+
+// usedLimiters returns the limiters without the nil ones (which don't limit anything).
+func usedLimiters(limiters []*throttle.Limiter) []*throttle.Limiter {
+	var used []*throttle.Limiter
+	for _, l := range limiters {
+		if l != nil {
+			used = append(used, l)
+		}
+	}
+	return used
+}
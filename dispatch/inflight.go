@@ -0,0 +1,102 @@
+package dispatch
+
+import (
+	"os"
+	"sync"
+)
+
+// inflight holds the transfers in progress into each folder. Their files are not complete yet in the folders, so the
+// capacity checks add them to the content of the folders.
+var inflight = inflightTransfers{folders: map[string]*pendingTransfers{}, reservations: map[string]uint64{}}
+
+type inflightTransfers struct {
+	mu           sync.Mutex
+	folders      map[string]*pendingTransfers
+	reservations map[string]uint64
+}
+
+type pendingTransfers struct {
+	files int
+	bytes int64
+}
+
+// version returns the version of the reservations into the folders, changed by every new reservation into one of
+// them. The folders are measured without lock: the version tells if they must be measured again.
+func (t *inflightTransfers) version(folders ...string) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var version uint64
+	for _, folder := range folders {
+		version += t.reservations[folder]
+	}
+	return version
+}
+
+// reserveAt reserves the folder like reserve, unless a file was reserved into the measured folders since their
+// version. Then the measures are stale and ok is false: two files are never given the last room of a folder.
+func (t *inflightTransfers) reserveAt(version uint64, measured []string, folder string, size int64) (release func(),
+	ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var current uint64
+	for _, f := range measured {
+		current += t.reservations[f]
+	}
+	if current != version {
+		return nil, false
+	}
+	return t.reserveLocked(folder, size), true
+}
+
+// reserve records a transfer of size bytes into the folder. The returned function must be called when the transfer
+// is over (successful or not).
+func (t *inflightTransfers) reserve(folder string, size int64) (release func()) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reserveLocked(folder, size)
+}
+
+func (t *inflightTransfers) reserveLocked(folder string, size int64) (release func()) {
+	t.reservations[folder]++
+	p, ok := t.folders[folder]
+	if !ok {
+		p = &pendingTransfers{}
+		t.folders[folder] = p
+	}
+	p.files++
+	p.bytes += size
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			p.files--
+			p.bytes -= size
+			if p.files == 0 {
+				delete(t.folders, folder)
+			}
+		})
+	}
+}
+
+// pending returns the number of files and bytes being transferred into the folder.
+func (t *inflightTransfers) pending(folder string) (files int, bytes int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if p, ok := t.folders[folder]; ok {
+		return p.files, p.bytes
+	}
+	return 0, 0
+}
+
+// fileSize returns the size of the file, or 0 if it's unknown.
+func fileSize(file os.FileInfo) int64 {
+	if file == nil {
+		return 0
+	}
+	return file.Size()
+}
@@ -0,0 +1,347 @@
+package dispatch
+
+import (
+	"FileFlow/files"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"sync"
+)
+
+// Journal is a write-ahead journal of the deliveries of a flow.
+// A delivery is written into the journal before the temporary file is renamed, and marked as ended once the source
+// file is removed. When FileFlow restarts after a crash, the deliveries left in the journal are completed or rolled
+// back by Recover.
+// A nil Journal journals nothing.
+type Journal struct {
+	mu     sync.Mutex
+	file   *os.File
+	nextID uint64
+	open   map[uint64]journalEntry
+	logger *slog.Logger
+}
+
+// journalEntry is a line of the journal.
+type journalEntry struct {
+	ID     uint64 `json:"id"`
+	State  string `json:"state"`
+	Source string `json:"src,omitempty"`
+	Temp   string `json:"tmp,omitempty"`
+	Dest   string `json:"dst,omitempty"`
+	Remote bool   `json:"remote,omitempty"`
+}
+
+const (
+	journalBegin = "begin"
+	journalEnd   = "end"
+)
+
+// SourceRemover is implemented by the FileProcessor able to remove the source files of their flow.
+type SourceRemover interface {
+	RemoveSource(src string) error
+}
+
+// OpenJournal opens (or creates) the journal file. The deliveries left by a previous run are kept until Recover is
+// called. The recovery is logged with the logger.
+func OpenJournal(name string, logger *slog.Logger) (*Journal, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open journal %s: %w", name, err)
+	}
+
+	j := &Journal{file: f, nextID: 1, open: make(map[uint64]journalEntry), logger: logger}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// The last line may be incomplete after a crash, the delivery wasn't begun then.
+			logger.Warn("Ignoring invalid line of journal", "journal", name, "error", err)
+			continue
+		}
+		switch entry.State {
+		case journalBegin:
+			j.open[entry.ID] = entry
+		case journalEnd:
+			delete(j.open, entry.ID)
+		}
+		if entry.ID >= j.nextID {
+			j.nextID = entry.ID + 1
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("cannot read journal %s: %w", name, err)
+	}
+
+	return j, nil
+}
+
+// Close closes the journal file.
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
+
+// Recover completes or rolls back the deliveries interrupted by a crash.
+// A delivery whose temporary file is still there is rolled back: the temporary file is removed and the source file is
+// kept to be delivered again. A delivery whose file is delivered is completed: the source file is removed.
+// The remote source files are removed by the remover.
+// It returns the number of completed and rolled back deliveries.
+func (j *Journal) Recover(remover SourceRemover) (completed int, rolledBack int, err error) {
+	if j == nil {
+		return 0, 0, nil
+	}
+
+	j.mu.Lock()
+	var pending []journalEntry
+	for _, entry := range j.open {
+		pending = append(pending, entry)
+	}
+	j.mu.Unlock()
+
+	for _, entry := range pending {
+		if _, err := os.Stat(entry.Temp); err == nil {
+			if err := os.Remove(entry.Temp); err != nil {
+				return completed, rolledBack, err
+			}
+			j.logger.Debug("Rolled back delivery", "src", entry.Source, "dst", entry.Dest)
+			rolledBack++
+		} else if _, err := os.Stat(entry.Dest); err == nil {
+			if err := removeSource(entry, remover); err != nil {
+				return completed, rolledBack, fmt.Errorf("cannot complete delivery of %s to %s: %w",
+					entry.Source, entry.Dest, err)
+			}
+			j.logger.Debug("Completed delivery", "src", entry.Source, "dst", entry.Dest)
+			completed++
+		}
+
+		if err := j.end(entry.ID); err != nil {
+			return completed, rolledBack, err
+		}
+	}
+
+	return completed, rolledBack, nil
+}
+
+// Complete completes the deliveries whose source file couldn't be removed: the source files are removed again. It's
+// called at each cycle, so that a source file isn't left in the journal until the next restart. The deliveries in
+// progress (their temporary file isn't renamed yet) are left.
+// It returns the number of completed deliveries, and the errors of the source files that still can't be removed.
+func (j *Journal) Complete(remover SourceRemover) (completed int, err error) {
+	if j == nil {
+		return 0, nil
+	}
+
+	j.mu.Lock()
+	var pending []journalEntry
+	for _, entry := range j.open {
+		pending = append(pending, entry)
+	}
+	j.mu.Unlock()
+
+	var errs []error
+	for _, entry := range pending {
+		if _, err := os.Stat(entry.Temp); err == nil {
+			continue
+		}
+		if err := removeSource(entry, remover); err != nil {
+			errs = append(errs, fmt.Errorf("cannot complete delivery of %s to %s: %w", entry.Source, entry.Dest, err))
+			continue
+		}
+		if err := j.end(entry.ID); err != nil {
+			return completed, err
+		}
+		j.logger.Debug("Completed delivery", "src", entry.Source, "dst", entry.Dest)
+		completed++
+	}
+
+	return completed, errors.Join(errs...)
+}
+
+// pending tells if the delivery of the source file is begun and not ended yet: the file must not be delivered again.
+func (j *Journal) pending(src string) bool {
+	if j == nil {
+		return false
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, entry := range j.open {
+		if entry.Source == src {
+			return true
+		}
+	}
+	return false
+}
+
+func removeSource(entry journalEntry, remover SourceRemover) error {
+	var err error
+	if !entry.Remote {
+		err = os.Remove(entry.Source)
+	} else if remover == nil {
+		return errors.New("the remote source files can't be removed")
+	} else {
+		err = remover.RemoveSource(entry.Source)
+	}
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// begin writes the delivery of the temporary file into the journal, before it's renamed.
+func (j *Journal) begin(src string, tmp string, dst string, remote bool) (uint64, error) {
+	if j == nil {
+		return 0, nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry := journalEntry{ID: j.nextID, State: journalBegin, Source: src, Temp: tmp, Dest: dst, Remote: remote}
+	if err := j.write(entry); err != nil {
+		return 0, err
+	}
+	j.nextID++
+	j.open[entry.ID] = entry
+	return entry.ID, nil
+}
+
+// end marks the delivery as ended. The journal is emptied when no delivery is left.
+func (j *Journal) end(id uint64) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.write(journalEntry{ID: id, State: journalEnd}); err != nil {
+		return err
+	}
+	delete(j.open, id)
+
+	if len(j.open) == 0 {
+		if err := j.file.Truncate(0); err != nil {
+			return fmt.Errorf("cannot empty journal %s: %w", j.file.Name(), err)
+		}
+	}
+	return nil
+}
+
+// write appends the entry to the journal and commits it to the storage. The journal must be locked.
+func (j *Journal) write(entry journalEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("cannot write journal %s: %w", j.file.Name(), err)
+	}
+	return j.file.Sync()
+}
+
+// committer delivers the temporary files of the transfers and removes their sources.
+// An exclusive committer doesn't replace a file already delivered: when the tree is flattened, files of different
+// subfolders may have the same name.
+type committer struct {
+	durable   bool
+	exclusive bool
+	journal   *Journal
+	remote    bool
+	logger    *slog.Logger
+}
+
+// committing holds the files being delivered by the exclusive committers, so that two files with the same name can't
+// both find their destination free.
+var committing = struct {
+	sync.Mutex
+	files map[string]bool
+}{files: make(map[string]bool)}
+
+// claim reserves the destination dst for the delivery of a file. It fails when dst is delivered or being delivered.
+// The reservation is released by calling the returned function.
+func claim(dst string) (func(), error) {
+	committing.Lock()
+	defer committing.Unlock()
+	if committing.files[dst] {
+		return nil, existingFile(dst)
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return nil, existingFile(dst)
+	}
+	committing.files[dst] = true
+	return func() {
+		committing.Lock()
+		defer committing.Unlock()
+		delete(committing.files, dst)
+	}, nil
+}
+
+// existingFile returns the error of a file that can't be delivered to dst because another file has the same name.
+func existingFile(dst string) error {
+	return fmt.Errorf("file %s is already delivered: %w", dst, fs.ErrExist)
+}
+
+// log returns the logger of the committer, the default logger if it has none.
+func (c committer) log() *slog.Logger {
+	if c.logger == nil {
+		return slog.Default()
+	}
+	return c.logger
+}
+
+// commit renames the complete temporary file tmp to dst, then removes the source file src with remove.
+// With durable delivery, the temporary file is synced before the rename and the destination folder after it, so that
+// the source file is only removed once the delivered file is on the storage. The delivery is journaled, if any.
+// An exclusive committer fails, removing the temporary file, when dst is already delivered.
+func (c committer) commit(src string, tmp string, dst string, remove func(string) error) error {
+	if c.exclusive {
+		release, err := claim(dst)
+		if err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+		defer release()
+	}
+
+	if c.durable {
+		if err := files.SyncFile(tmp); err != nil {
+			return fmt.Errorf("error syncing file %s: %v", tmp, err)
+		}
+	}
+
+	id, err := c.journal.begin(src, tmp, dst, c.remote)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = c.journal.end(id)
+		return fmt.Errorf("error renaming file %s to %s: %v", tmp, dst, err)
+	}
+
+	if c.durable {
+		if err := files.SyncDir(path.Dir(dst)); err != nil {
+			// The source file is kept: the delivery is completed by Complete, or by Recover if the file survives a crash.
+			return fmt.Errorf("error syncing folder %s: %v", path.Dir(dst), err)
+		}
+	}
+
+	if err := remove(src); err != nil {
+		// The delivery is left in the journal to be completed by Complete at the next cycle.
+		c.log().Warn("Cannot remove file", "file", src, "error", err)
+		return nil
+	}
+	c.log().Info("Removed file", "file", src)
+
+	return c.journal.end(id)
+}
@@ -0,0 +1,186 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"FileFlow/files"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type sourceRecorder struct {
+	removed []string
+}
+
+func (r *sourceRecorder) RemoveSource(src string) error {
+	r.removed = append(r.removed, src)
+	return nil
+}
+
+// failingRemover fails to remove the source files until it's fixed.
+type failingRemover struct {
+	fixed   bool
+	removed []string
+}
+
+func (r *failingRemover) RemoveSource(src string) error {
+	if !r.fixed {
+		return os.ErrPermission
+	}
+	r.removed = append(r.removed, src)
+	return nil
+}
+
+func TestDurableJournaledMove(t *testing.T) {
+	// Given
+	source := t.TempDir()
+	dest := t.TempDir()
+	src := createFile(t, source, "file_A")
+	journalFile := filepath.Join(t.TempDir(), "acme.journal")
+	journal, err := OpenJournal(journalFile, slog.Default())
+	if err != nil {
+		t.Fatalf("Error opening journal: %s", err)
+	}
+	defer journal.Close()
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: source, Durable: true, Journal: journalFile}
+	processor := Open(flow).Journaled(journal)
+
+	// When
+	err = processor.ProcessFile(context.Background(), src, dest+"/file_A", fileflows.Move)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Error processing file: %s", err)
+	}
+
+	if _, err := os.Stat(dest + "/file_A"); err != nil {
+		t.Errorf("File should be found: %s", dest+"/file_A")
+	}
+
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("Source file should be removed: %s", src)
+	}
+
+	if info, err := os.Stat(journalFile); err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty journal once the delivery is ended")
+	}
+}
+
+func TestJournalRecover(t *testing.T) {
+	// Given
+	source := t.TempDir()
+	dest := t.TempDir()
+	journalFile := filepath.Join(t.TempDir(), "acme.journal")
+	journal, err := OpenJournal(journalFile, slog.Default())
+	if err != nil {
+		t.Fatalf("Error opening journal: %s", err)
+	}
+
+	// file_A crashed before its rename: its delivery is rolled back.
+	srcA := createFile(t, source, "file_A")
+	tmpA := createFile(t, dest, files.TempFile("file_A"))
+	if _, err := journal.begin(srcA, tmpA, dest+"/file_A", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// file_B crashed after its rename: its delivery is completed.
+	srcB := createFile(t, source, "file_B")
+	dstB := createFile(t, dest, "file_B")
+	if _, err := journal.begin(srcB, files.TempFile(dstB), dstB, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// file_C comes from the SFTP server and crashed after its rename.
+	dstC := createFile(t, dest, "file_C")
+	if _, err := journal.begin("sftp/acme/file_C", files.TempFile(dstC), dstC, true); err != nil {
+		t.Fatal(err)
+	}
+	_ = journal.Close()
+
+	// When
+	journal, err = OpenJournal(journalFile, slog.Default())
+	if err != nil {
+		t.Fatalf("Error opening journal: %s", err)
+	}
+	defer journal.Close()
+	remover := &sourceRecorder{}
+	completed, rolledBack, err := journal.Recover(remover)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Error recovering journal: %s", err)
+	}
+
+	if completed != 2 || rolledBack != 1 {
+		t.Errorf("Expected 2 completed and 1 rolled back deliveries, got %d and %d", completed, rolledBack)
+	}
+
+	if _, err := os.Stat(tmpA); !os.IsNotExist(err) {
+		t.Errorf("Temporary file should be removed: %s", tmpA)
+	}
+
+	if _, err := os.Stat(srcA); err != nil {
+		t.Errorf("Source file should be kept: %s", srcA)
+	}
+
+	if _, err := os.Stat(srcB); !os.IsNotExist(err) {
+		t.Errorf("Source file should be removed: %s", srcB)
+	}
+
+	if len(remover.removed) != 1 || remover.removed[0] != "sftp/acme/file_C" {
+		t.Errorf("Expected sftp/acme/file_C to be removed from the server, got %v", remover.removed)
+	}
+
+	if info, err := os.Stat(journalFile); err != nil || info.Size() != 0 {
+		t.Errorf("Expected an empty journal once the deliveries are recovered")
+	}
+}
+
+func TestJournalCompletesUnremovedSource(t *testing.T) {
+	// Given
+	dest := t.TempDir()
+	journalFile := filepath.Join(t.TempDir(), "acme.journal")
+	journal, err := OpenJournal(journalFile, slog.Default())
+	if err != nil {
+		t.Fatalf("Error opening journal: %s", err)
+	}
+	defer journal.Close()
+	remover := &failingRemover{}
+	processor := committer{journal: journal, remote: true}
+
+	// file_A is delivered but its source can't be removed.
+	tmpA := createFile(t, dest, files.TempFile("file_A"))
+	if err := processor.commit("sftp/acme/file_A", tmpA, dest+"/file_A", remover.RemoveSource); err != nil {
+		t.Fatalf("Error committing file: %s", err)
+	}
+
+	// file_B is being delivered.
+	tmpB := createFile(t, dest, files.TempFile("file_B"))
+	if _, err := journal.begin("sftp/acme/file_B", tmpB, dest+"/file_B", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// When
+	completedFailing, errFailing := journal.Complete(remover)
+	remover.fixed = true
+	completed, err := journal.Complete(remover)
+
+	// Then
+	if completedFailing != 0 || errFailing == nil {
+		t.Errorf("Expected the source file to stay not removed, got %d completed deliveries and %v", completedFailing, errFailing)
+	}
+
+	if err != nil || completed != 1 {
+		t.Fatalf("Expected 1 completed delivery, got %d (%v)", completed, err)
+	}
+
+	if len(remover.removed) != 1 || remover.removed[0] != "sftp/acme/file_A" {
+		t.Errorf("Expected sftp/acme/file_A to be removed from the server, got %v", remover.removed)
+	}
+
+	if journal.pending("sftp/acme/file_A") || !journal.pending("sftp/acme/file_B") {
+		t.Errorf("Expected only the delivery of file_B to be left in the journal")
+	}
+}
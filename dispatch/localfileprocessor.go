@@ -2,17 +2,21 @@ package dispatch
 
 import (
 	"FileFlow/fileflows"
+	"FileFlow/files"
+	"FileFlow/logging"
+	"FileFlow/throttle"
+	"context"
 	"fmt"
 	"github.com/kr/fs"
 	"io"
-	"log"
 	"os"
 	"path"
-	"sort"
 )
 
 type LocalFileProcessor struct {
 	sourceFolder string
+	limiters     []*throttle.Limiter
+	committer
 }
 
 // Close is a noop in this context
@@ -22,104 +26,110 @@ func (p LocalFileProcessor) Close() {
 func Open(flow fileflows.FileFlow) LocalFileProcessor {
 	return LocalFileProcessor{
 		sourceFolder: flow.SourceFolder,
+		committer:    committer{durable: flow.Durable, exclusive: !flow.PreserveTree, logger: logging.ForFlow(flow.Name)},
 	}
 }
 
+// Throttled returns a copy of the processor whose transfers are limited by the limiters.
+func (p LocalFileProcessor) Throttled(limiters ...*throttle.Limiter) LocalFileProcessor {
+	p.limiters = usedLimiters(limiters)
+	return p
+}
+
+// Journaled returns a copy of the processor whose deliveries are written into the journal.
+func (p LocalFileProcessor) Journaled(journal *Journal) LocalFileProcessor {
+	p.journal = journal
+	return p
+}
+
 // ListFiles list the files in the given directory that match the given pattern of the flow
 func (p LocalFileProcessor) ListFiles(flow fileflows.FileFlow) FileList {
 	if p.sourceFolder != flow.SourceFolder {
-		log.Fatal("source folder of the current processor does not match the flow source folder")
+		p.log().Error("Source folder of the current processor does not match the flow source folder",
+			"folder", p.sourceFolder, "flow_folder", flow.SourceFolder)
+		os.Exit(1)
 	}
 
 	if _, err := os.Stat(p.sourceFolder); err != nil {
 		if os.IsNotExist(err) {
-			log.Printf("WARN source folder %s does not exist", p.sourceFolder)
-			return []os.FileInfo{}
-		}
-	}
-
-	walker := fs.Walk(p.sourceFolder)
-	var files = make(FileList, 0, 50)
-	for walker.Step() {
-		fileInfo := walker.Stat()
-		if !fileInfo.IsDir() && flow.Regexp.MatchString(fileInfo.Name()) {
-			files = append(files, fileInfo)
+			p.log().Warn("Source folder does not exist", "folder", p.sourceFolder)
+			return FileList{}
 		}
 	}
 
-	sort.Sort(files)
-	return files
+	return collectFiles(fs.Walk(p.sourceFolder), flow)
 }
 
 // ProcessFile do an action on a file from a local directory
 // src parameter is the source full file path
 // dst parameter is the destination full file path
 // operation parameter is the operation to do
-func (p LocalFileProcessor) ProcessFile(src string, dst string, operation fileflows.FlowOperation) error {
+func (p LocalFileProcessor) ProcessFile(ctx context.Context, src string, dst string, operation fileflows.FlowOperation) error {
 
 	inp, err := os.Open(src)
 	if err != nil {
 		return err
 	}
 	defer inp.Close()
+	defer abortOnDone(ctx, inp)()
 
+	tmpDst, finalName := files.TempFile(dst), dst
 	if operation == fileflows.Move {
-		tmpDst := dst + ".tmp"
 		out, err := os.Create(tmpDst)
 		if err != nil {
 			return err
 		}
 		defer out.Close()
-		log.Printf("Moving %s to %s", src, dst)
-		_, err = io.Copy(out, inp)
+		p.log().Info("Moving file", "src", src, "dst", dst)
+		w, digested := digestWriter(ctx, out)
+		_, err = io.Copy(w, throttle.Reader(ctx, inp, p.limiters...))
 		if err != nil {
+			_ = os.Remove(tmpDst)
 			return fmt.Errorf("error copying file %s to %s: %v", src, tmpDst, err)
 		}
-		if err := os.Rename(tmpDst, dst); err != nil {
-			return fmt.Errorf("error renaming file %s to %s: %v", tmpDst, dst, err)
-		}
+		digested()
 
 	} else if operation == fileflows.Compression {
-		if err := compressOperation(src, dst, inp); err != nil {
+		if tmpDst, finalName, err = compressOperation(ctx, src, dst, throttle.Reader(ctx, inp, p.limiters...), p.log()); err != nil {
 			return err
 		}
 	} else if operation == fileflows.Decompression {
-		if err := uncompressOperation(src, dst, inp); err != nil {
+		if tmpDst, finalName, err = uncompressOperation(ctx, src, dst, throttle.Reader(ctx, inp, p.limiters...), p.log()); err != nil {
 			return err
 		}
 	}
 
-	_ = os.Remove(src)
-	log.Printf("Removed file %s", src)
-
-	return nil
+	return p.commit(src, tmpDst, finalName, os.Remove)
 }
 
 // OverflowFile move a file to the overflow directory.
 // If success, dst contains the full path of the file
-func (p LocalFileProcessor) OverflowFile(src string, overflowFolder string) (dst string, err error) {
+func (p LocalFileProcessor) OverflowFile(ctx context.Context, src string, overflowFolder string) (dst string, err error) {
 	inp, err := os.Open(src)
 	if err != nil {
 		return "", fmt.Errorf("error opening file %s: %v", src, err)
 	}
 	defer inp.Close()
+	defer abortOnDone(ctx, inp)()
 
 	fileName := path.Base(src)
-	tmp := ConcatFolderWithFile(overflowFolder, fileName+".tmp")
+	tmp := files.TempFile(ConcatFolderWithFile(overflowFolder, fileName))
 	out, err := os.Create(tmp)
 	if err != nil {
 		return "", fmt.Errorf("error creating file %s: %v", tmp, err)
 	}
+	defer out.Close()
 
-	if _, err := io.Copy(out, inp); err != nil {
+	w, digested := digestWriter(ctx, out)
+	if _, err := io.Copy(w, throttle.Reader(ctx, inp, p.limiters...)); err != nil {
+		_ = os.Remove(tmp)
 		return "", fmt.Errorf("error copying file %s to %s: %v", src, tmp, err)
 	}
+	digested()
 
 	dst = ConcatFolderWithFile(overflowFolder, fileName)
-	if err := os.Rename(tmp, dst); err != nil {
-		return "", fmt.Errorf("error renaming file %s to %s: %v", tmp, dst, err)
+	if err := p.commit(src, tmp, dst, os.Remove); err != nil {
+		return "", err
 	}
-
-	_ = os.Remove(src)
 	return dst, nil
 }
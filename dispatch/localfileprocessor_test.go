@@ -0,0 +1,109 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"FileFlow/files"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"testing"
+)
+
+func TestListFilesWithMaxDepth(t *testing.T) {
+	// Given
+	source := t.TempDir()
+	for _, name := range []string{"file_A", "sub/file_B", "sub/deeper/file_C"} {
+		createFile(t, source, name)
+	}
+
+	pattern := "file_.+"
+	var tests = []struct {
+		maxDepth int
+		expected []string
+	}{
+		{0, []string{"file_A", "sub/deeper/file_C", "sub/file_B"}},
+		{1, []string{"file_A"}},
+		{2, []string{"file_A", "sub/file_B"}},
+	}
+
+	for _, test := range tests {
+		flow := fileflows.NewLocalFileFlow("Move ACME files", source, pattern, []string{"/dest"}, fileflows.Move, 0, "")
+		flow.MaxDepth = test.maxDepth
+
+		// When
+		files := Open(flow).ListFiles(flow)
+
+		// Then
+		if len(files) != len(test.expected) {
+			t.Fatalf("Expected %d files with max depth %d, got %d", len(test.expected), test.maxDepth, len(files))
+		}
+
+		for i, f := range files {
+			if f.Path != test.expected[i] {
+				t.Errorf("Expected %s, got %s", test.expected[i], f.Path)
+			}
+		}
+	}
+}
+
+func TestListFilesMatchesFileNameOnly(t *testing.T) {
+	// Given
+	source := t.TempDir()
+	createFile(t, source, "acme/file_A")
+	createFile(t, source, "acme/other")
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: source, DestinationFolders: []string{"/dest"}, Regexp: regexp.MustCompile("^file_")}
+
+	// When
+	files := Open(flow).ListFiles(flow)
+
+	// Then
+	if len(files) != 1 || files[0].Path != "acme/file_A" {
+		t.Errorf("Expected only acme/file_A, got %v", files)
+	}
+}
+
+func TestMoveDoesNotReplaceFlattenedFile(t *testing.T) {
+	// Given
+	source := t.TempDir()
+	dest := t.TempDir()
+	src := createFile(t, source, "sub/file_A")
+	if err := os.WriteFile(dest+"/file_A", []byte("Delivered file.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: source, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile("^file_")}
+
+	// When
+	err := Open(flow).ProcessFile(context.Background(), src, dest+"/file_A", fileflows.Move)
+
+	// Then
+	if !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("Expected the move to fail as file_A is already delivered, got %v", err)
+	}
+
+	if content, _ := os.ReadFile(dest + "/file_A"); string(content) != "Delivered file.\n" {
+		t.Errorf("Expected delivered file to be kept, got %q", content)
+	}
+
+	if _, err := os.Stat(src); err != nil {
+		t.Errorf("Expected source file to be kept: %s", err)
+	}
+
+	if _, err := os.Stat(files.TempFile(dest + "/file_A")); err == nil {
+		t.Errorf("Expected temporary file to be removed")
+	}
+}
+
+func createFile(t *testing.T, folder string, name string) string {
+	t.Helper()
+	filePath := path.Join(folder, name)
+	if err := os.MkdirAll(path.Dir(filePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte("This is a test file.\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filePath
+}
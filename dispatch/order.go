@@ -0,0 +1,153 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// Less tells if the file a must be processed before the file b.
+type Less func(a, b SourceFile) bool
+
+// NewOrder returns the order set in the flow to process its files:
+//   - name (the default): by path name
+//   - oldest: the oldest modification time first (FIFO)
+//   - newest: the newest modification time first
+//   - smallest: the smallest size first
+//   - largest: the largest size first
+//   - natural: by natural order of the capture group set by order_group (or of the file name without group),
+//     so the numbers are compared by value: batch_9 comes before batch_10
+//
+// The files that are equal for the order are sorted by path name.
+func NewOrder(flow *fileflows.FileFlow) (Less, error) {
+	switch flow.Order {
+	case "", "name":
+		return byPath, nil
+	case "oldest":
+		return func(a, b SourceFile) bool {
+			if a.ModTime().Equal(b.ModTime()) {
+				return byPath(a, b)
+			}
+			return a.ModTime().Before(b.ModTime())
+		}, nil
+	case "newest":
+		return func(a, b SourceFile) bool {
+			if a.ModTime().Equal(b.ModTime()) {
+				return byPath(a, b)
+			}
+			return a.ModTime().After(b.ModTime())
+		}, nil
+	case "smallest":
+		return func(a, b SourceFile) bool {
+			if a.Size() == b.Size() {
+				return byPath(a, b)
+			}
+			return a.Size() < b.Size()
+		}, nil
+	case "largest":
+		return func(a, b SourceFile) bool {
+			if a.Size() == b.Size() {
+				return byPath(a, b)
+			}
+			return a.Size() > b.Size()
+		}, nil
+	case "natural":
+		group, err := captureGroup(flow, flow.OrderGroup)
+		if err != nil {
+			return nil, err
+		}
+		return func(a, b SourceFile) bool {
+			ka, kb := groupValue(flow, group, a), groupValue(flow, group, b)
+			if ka == kb {
+				return byPath(a, b)
+			}
+			return naturalLess(ka, kb)
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown file order %q", flow.Order)
+}
+
+// SortBy sorts the files with the order.
+func (fl FileList) SortBy(less Less) {
+	sort.SliceStable(fl, func(i, j int) bool {
+		return less(fl[i], fl[j])
+	})
+}
+
+func byPath(a, b SourceFile) bool {
+	return a.Path < b.Path
+}
+
+// captureGroup returns the index of the capture group of the flow pattern. The group is its number or its name.
+// An empty group is the whole match (0).
+func captureGroup(flow *fileflows.FileFlow, group string) (int, error) {
+	if group == "" {
+		return 0, nil
+	}
+
+	index, err := strconv.Atoi(group)
+	if err != nil {
+		index = flow.Regexp.SubexpIndex(group)
+	}
+	if index < 0 || index > flow.Regexp.NumSubexp() {
+		return 0, fmt.Errorf("%s is not a capture group of pattern %s", group, flow.Pattern)
+	}
+	return index, nil
+}
+
+// groupValue returns the value of the capture group for the file name.
+// The file name is returned for the group 0 or when the group doesn't match.
+func groupValue(flow *fileflows.FileFlow, group int, file SourceFile) string {
+	name := path.Base(file.Path)
+	if group == 0 {
+		return name
+	}
+
+	match := flow.Regexp.FindStringSubmatch(name)
+	if match == nil || match[group] == "" {
+		return name
+	}
+	return match[group]
+}
+
+// naturalLess compares two strings where the digit sequences are compared by numerical value.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := digitPrefix(a), digitPrefix(b)
+		if da == "" || db == "" {
+			if a[0] != b[0] {
+				return a[0] < b[0]
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		na, nb := trimZeros(da), trimZeros(db)
+		if len(na) != len(nb) {
+			return len(na) < len(nb)
+		}
+		if na != nb {
+			return na < nb
+		}
+		a, b = a[len(da):], b[len(db):]
+	}
+	return len(a) < len(b)
+}
+
+func digitPrefix(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
+
+func trimZeros(digits string) string {
+	for len(digits) > 1 && digits[0] == '0' {
+		digits = digits[1:]
+	}
+	return digits
+}
@@ -0,0 +1,97 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestFileOrders(t *testing.T) {
+	// Given
+	now := time.Now()
+	list := FileList{
+		{fakeFileInfo{"batch_10.csv", 30, now.Add(-time.Hour)}, "batch_10.csv"},
+		{fakeFileInfo{"batch_9.csv", 10, now}, "batch_9.csv"},
+		{fakeFileInfo{"batch_100.csv", 20, now.Add(-2 * time.Hour)}, "batch_100.csv"},
+	}
+
+	pattern := `^batch_(\d+)\.csv$`
+	var tests = []struct {
+		order    string
+		expected []string
+	}{
+		{"", []string{"batch_10.csv", "batch_100.csv", "batch_9.csv"}},
+		{"oldest", []string{"batch_100.csv", "batch_10.csv", "batch_9.csv"}},
+		{"newest", []string{"batch_9.csv", "batch_10.csv", "batch_100.csv"}},
+		{"smallest", []string{"batch_9.csv", "batch_100.csv", "batch_10.csv"}},
+		{"largest", []string{"batch_10.csv", "batch_100.csv", "batch_9.csv"}},
+		{"natural", []string{"batch_9.csv", "batch_10.csv", "batch_100.csv"}},
+	}
+
+	for _, test := range tests {
+		flow := fileflows.FileFlow{Name: "Move ACME files", Pattern: pattern, Regexp: regexp.MustCompile(pattern), Order: test.order, OrderGroup: "1"}
+		less, err := NewOrder(&flow)
+		if err != nil {
+			t.Fatalf("Error creating order %s: %s", test.order, err)
+		}
+
+		// When
+		sorted := append(FileList{}, list...)
+		sorted.SortBy(less)
+
+		// Then
+		for i, f := range sorted {
+			if f.Path != test.expected[i] {
+				t.Errorf("Expected %s at %d with order %q, got %s", test.expected[i], i, test.order, f.Path)
+			}
+		}
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	var tests = []struct {
+		a, b string
+		less bool
+	}{
+		{"batch_9", "batch_10", true},
+		{"batch_10", "batch_9", false},
+		{"batch_009", "batch_10", true},
+		{"a2b10", "a2b9", false},
+		{"file", "file_1", true},
+		{"b1", "a2", false},
+	}
+
+	for _, test := range tests {
+		if less := naturalLess(test.a, test.b); less != test.less {
+			t.Errorf("Expected %s < %s to be %v", test.a, test.b, test.less)
+		}
+	}
+}
+
+func TestUnknownOrder(t *testing.T) {
+	// Given
+	flow := fileflows.FileFlow{Name: "Move ACME files", Order: "random"}
+
+	// When
+	_, err := NewOrder(&flow)
+
+	// Then
+	if err == nil {
+		t.Errorf("Expected error, got nothing")
+	}
+}
+
+type fakeFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (f fakeFileInfo) Name() string       { return f.name }
+func (f fakeFileInfo) Size() int64        { return f.size }
+func (f fakeFileInfo) Mode() os.FileMode  { return 0644 }
+func (f fakeFileInfo) ModTime() time.Time { return f.modTime }
+func (f fakeFileInfo) IsDir() bool        { return false }
+func (f fakeFileInfo) Sys() any           { return nil }
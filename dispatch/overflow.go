@@ -0,0 +1,164 @@
+package dispatch
+
+import (
+	"FileFlow/audit"
+	"FileFlow/files"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kr/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DrainOverflow moves the files of the overflow folders back into the destination folders, as long as the
+// destination folders are available.
+// The files of an overflow folder are delivered by order of arrival. The draining of an overflow folder stops at
+// the first file that can't be delivered, so that the files never overtake each other. A file whose content can't
+// go through the operation of the flow (a corrupted gzip file for instance) is moved into the quarantine folder
+// instead, as it could never be delivered.
+// No more file is started once stop is closed, the context is done or the budget of the cycle is spent.
+// It returns the number of delivered files. The deliveries are traced as spans of the context.
+func (d *Dispatcher) DrainOverflow(ctx context.Context, stop <-chan struct{}) (int, error) {
+	drained := 0
+	for _, overflowFolder := range d.flow.AllOverflowFolders() {
+		n, err := d.drain(ctx, stop, overflowFolder)
+		drained += n
+		if err != nil {
+			return drained, err
+		}
+	}
+	return drained, nil
+}
+
+func (d *Dispatcher) drain(ctx context.Context, stop <-chan struct{}, overflowFolder string) (int, error) {
+	overflowed, err := listOverflow(overflowFolder)
+	if err != nil {
+		return 0, err
+	}
+
+	var destinations []string
+	for _, folder := range d.flow.DestinationFolders {
+		if d.flow.OverflowFolderOf(folder) == overflowFolder {
+			destinations = append(destinations, folder)
+		}
+	}
+
+	processor := LocalFileProcessor{
+		sourceFolder: overflowFolder,
+		committer:    committer{durable: d.flow.Durable, exclusive: !d.flow.PreserveTree, journal: d.journal, logger: d.logger},
+	}
+	drained := 0
+	for _, file := range overflowed {
+		select {
+		case <-stop:
+			return drained, nil
+		case <-ctx.Done():
+			return drained, nil
+		default:
+		}
+
+		src := ConcatFolderWithFile(overflowFolder, file.Path)
+		// The file is drained but couldn't be removed: its delivery is completed by the journal.
+		if d.journal.pending(src) {
+			continue
+		}
+
+		if !d.budget.Reserve(file.Size()) {
+			return drained, nil
+		}
+		folder, release := d.availableFolder(file, destinations)
+		if folder == "" {
+			d.budget.Settle(file.Size(), false)
+			break
+		}
+
+		start := time.Now()
+		fileCtx, digest := d.withDigest(ctx)
+		dst, err := d.destination(folder, file.Path)
+		if err == nil {
+			err = d.processFile(fileCtx, processor, src, dst)
+		}
+		release()
+		d.budget.Settle(file.Size(), err == nil)
+		d.report(src, file.Size(), deliveredFile(dst, d.flow.Operation), audit.Delivered, digest.Sum(), start, err)
+		var contentError ContentError
+		if errors.As(err, &contentError) {
+			quarantined, err := d.quarantine(overflowFolder, file.Path)
+			if err != nil {
+				return drained, fmt.Errorf("cannot quarantine overflow file %s: %w", src, err)
+			}
+			processor.log().Warn("Quarantined overflow file", "src", src, "dst", quarantined, "error", contentError)
+			continue
+		}
+		if err != nil {
+			return drained, fmt.Errorf("cannot drain overflow file %s: %w", src, err)
+		}
+
+		processor.log().Debug("Drained overflow file", "src", src, "dst", dst)
+		drained++
+	}
+
+	return drained, nil
+}
+
+// quarantine moves the overflowed file into the quarantine folder (keeping its path relative to the overflow folder),
+// so that a file that can never be drained doesn't hold up the next ones. It returns the quarantined file.
+func (d *Dispatcher) quarantine(overflowFolder string, file string) (string, error) {
+	dst := ConcatFolderWithFile(d.flow.QuarantineFolderOf(overflowFolder), file)
+	if err := os.MkdirAll(path.Dir(dst), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(ConcatFolderWithFile(overflowFolder, file), dst); err != nil {
+		return "", err
+	}
+	return dst, nil
+}
+
+// availableFolder returns the first destination folder the strategy proposes that is available for the file.
+// It's empty when no folder is available. The folder is reserved for the file until release is called.
+func (d *Dispatcher) availableFolder(file SourceFile, destinations []string) (folder string, release func()) {
+	for _, folder := range d.candidates(file, destinations) {
+		if release, ok := d.reserveIfAvailable(file, folder, ""); ok {
+			d.dispatched(file, folder)
+			return folder, release
+		}
+	}
+	return "", nil
+}
+
+// listOverflow returns the files of the overflow folder (and its subfolders), from the oldest to the newest.
+// The temporary files of the transfers in progress are skipped.
+func listOverflow(overflowFolder string) (FileList, error) {
+	if _, err := os.Stat(overflowFolder); os.IsNotExist(err) {
+		return FileList{}, nil
+	}
+
+	root := strings.TrimSuffix(overflowFolder, "/")
+	walker := fs.Walk(root)
+	var overflowed = make(FileList, 0, 50)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("cannot list overflow folder %s: %w", overflowFolder, err)
+		}
+
+		fileInfo := walker.Stat()
+		if !fileInfo.Mode().IsRegular() || files.IsTempFile(fileInfo.Name()) {
+			continue
+		}
+
+		rel := strings.TrimPrefix(walker.Path(), root+"/")
+		overflowed = append(overflowed, SourceFile{fileInfo, rel})
+	}
+
+	sort.SliceStable(overflowed, func(i, j int) bool {
+		if overflowed[i].ModTime().Equal(overflowed[j].ModTime()) {
+			return overflowed[i].Path < overflowed[j].Path
+		}
+		return overflowed[i].ModTime().Before(overflowed[j].ModTime())
+	})
+	return overflowed, nil
+}
@@ -0,0 +1,230 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDrainOverflowByOrderOfArrival(t *testing.T) {
+	// Given
+	pattern := ".+"
+	overflow := t.TempDir()
+	dest := t.TempDir()
+	arrival := time.Now().Add(-time.Hour)
+	for i, name := range []string{"file_C", "file_A", "file_B"} {
+		f := createFile(t, overflow, name)
+		if err := os.Chtimes(f, arrival, arrival.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern), Operation: fileflows.Move, MaxFileCount: 2, OverflowFolder: overflow}
+
+	// When
+	dispatcher := NewDispatcher(&flow, ByFileCount{MaxFileCount: flow.MaxFileCount}, noop)
+	drained, err := dispatcher.DrainOverflow(context.Background(), nil)
+
+	// Then
+	if err != nil {
+		t.Errorf("Error draining overflow: %s", err)
+	}
+
+	if drained != 2 {
+		t.Errorf("Expected 2 drained files, got %d", drained)
+	}
+
+	for _, name := range []string{"file_C", "file_A"} {
+		if _, err := os.Stat(dest + "/" + name); err != nil {
+			t.Errorf("File should be found: %s", dest+"/"+name)
+		}
+	}
+
+	if _, err := os.Stat(overflow + "/file_B"); err != nil {
+		t.Errorf("File should be kept in overflow: %s", overflow+"/file_B")
+	}
+}
+
+func TestDrainOverflowStopsWhenStopping(t *testing.T) {
+	// Given
+	pattern := ".+"
+	overflow := t.TempDir()
+	dest := t.TempDir()
+	createFile(t, overflow, "file_A")
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern), Operation: fileflows.Move, OverflowFolder: overflow}
+	stop := make(chan struct{})
+	close(stop)
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), noop)
+	drained, err := dispatcher.DrainOverflow(context.Background(), stop)
+
+	// Then
+	if err != nil || drained != 0 {
+		t.Errorf("Expected no drained file, got %d and error %v", drained, err)
+	}
+	if _, err := os.Stat(overflow + "/file_A"); err != nil {
+		t.Errorf("File should be kept in overflow: %s", overflow+"/file_A")
+	}
+}
+
+func TestDrainedFilesUseTheBudget(t *testing.T) {
+	// Given
+	pattern := ".+"
+	overflow := t.TempDir()
+	dest := t.TempDir()
+	createFile(t, overflow, "file_A")
+	createFile(t, overflow, "file_B")
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern), Operation: fileflows.Move, OverflowFolder: overflow}
+	budget := NewBudget(1, 0)
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), noop).WithBudget(budget)
+	drained, err := dispatcher.DrainOverflow(context.Background(), nil)
+
+	// Then
+	if err != nil || drained != 1 {
+		t.Errorf("Expected 1 drained file, got %d and error %v", drained, err)
+	}
+	if budget.Reserve(0) {
+		t.Errorf("Budget of the cycle should be spent by the drained file")
+	}
+}
+
+func TestNewFilesWaitForOverflowDraining(t *testing.T) {
+	// Given
+	pattern := ".+"
+	overflow := t.TempDir()
+	dest := t.TempDir()
+	createFile(t, overflow, "sub/file_A")
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern), OverflowFolder: overflow, PreserveTree: true}
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), overflowRecorder{})
+	before, err := dispatcher.Dispatch(context.Background(), "file_B")
+	if err != nil {
+		t.Fatalf("Error dispatching file: %s", err)
+	}
+	if _, err := dispatcher.DrainOverflow(context.Background(), nil); err != nil {
+		t.Fatalf("Error draining overflow: %s", err)
+	}
+	after, err := dispatcher.Dispatch(context.Background(), "file_C")
+
+	// Then
+	if err != nil {
+		t.Errorf("Error dispatching file: %s", err)
+	}
+
+	if before != overflow+"/file_B" {
+		t.Errorf("Expected destination: %s, got: %s", overflow+"/file_B", before)
+	}
+
+	if _, err := os.Stat(dest + "/sub/file_A"); err != nil {
+		t.Errorf("File should be found: %s", dest+"/sub/file_A")
+	}
+
+	if after != dest+"/file_C" {
+		t.Errorf("Expected destination: %s, got: %s", dest+"/file_C", after)
+	}
+}
+
+func TestRejectedFileIsNotOverflowed(t *testing.T) {
+	// Given
+	pattern := ".+"
+	overflow := t.TempDir()
+	dest := t.TempDir()
+	createFile(t, dest, "file_A")
+	source := t.TempDir()
+	big := fileInfo(t, createFile(t, source, "file_B")) // 21 bytes
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: source, Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern), Operation: fileflows.Move, MaxFileCount: 1, MaxFileSize: 10, OverflowFolder: overflow}
+	fa, err := NewFolderAvailability(&flow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// When
+	dispatcher := NewDispatcher(&flow, fa, Open(flow))
+	_, err = dispatcher.DispatchFile(context.Background(), SourceFile{big, "file_B"})
+
+	// Then
+	var rejected RejectedFileError
+	if !errors.As(err, &rejected) {
+		t.Errorf("Expected rejected file, got %v", err)
+	}
+	if _, err := os.Stat(source + "/file_B"); err != nil {
+		t.Errorf("File should be kept in source: %s", source+"/file_B")
+	}
+
+	// The overflow folder doesn't block the destination folder once it's emptied.
+	if err := os.Remove(dest + "/file_A"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dispatcher.DrainOverflow(context.Background(), nil); err != nil {
+		t.Fatalf("Error draining overflow: %s", err)
+	}
+	if err := os.WriteFile(source+"/file_C", []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	small := fileInfo(t, source+"/file_C")
+	if dst, err := dispatcher.DispatchFile(context.Background(), SourceFile{small, "file_C"}); err != nil || dst != dest+"/file_C" {
+		t.Errorf("Expected file delivered into %s, got %s (%v)", dest, dst, err)
+	}
+}
+
+func TestFileNotSuitingTheOperationIsNotOverflowed(t *testing.T) {
+	// Given
+	pattern := ".+"
+	overflow := t.TempDir()
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/dest1"}, Regexp: regexp.MustCompile(pattern), Operation: fileflows.Decompression, OverflowFolder: overflow}
+
+	// When
+	dispatcher := NewDispatcher(&flow, mockFullFolderAvailability{}, overflowRecorder{})
+	_, err := dispatcher.Dispatch(context.Background(), "file_A.csv")
+
+	// Then
+	var contentError ContentError
+	if !errors.As(err, &contentError) {
+		t.Errorf("Expected content error, got %v", err)
+	}
+}
+
+func TestUndrainableFileIsQuarantined(t *testing.T) {
+	// Given
+	pattern := ".+"
+	overflow := t.TempDir()
+	quarantine := t.TempDir()
+	dest := t.TempDir()
+	createFile(t, overflow, "file_A.gz") // not a gzip file
+	var compressed bytes.Buffer
+	if err := compressFile(strings.NewReader("This is a test file.\n"), &compressed); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(overflow+"/file_B.gz", compressed.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(overflow+"/file_B.gz", later, later); err != nil {
+		t.Fatal(err)
+	}
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern), Operation: fileflows.Decompression, OverflowFolder: overflow, QuarantineFolder: quarantine}
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), noop)
+	drained, err := dispatcher.DrainOverflow(context.Background(), nil)
+
+	// Then
+	if err != nil || drained != 1 {
+		t.Errorf("Expected 1 drained file, got %d and error %v", drained, err)
+	}
+	if _, err := os.Stat(quarantine + "/file_A.gz"); err != nil {
+		t.Errorf("File should be quarantined: %s", quarantine+"/file_A.gz")
+	}
+	if _, err := os.Stat(dest + "/file_B"); err != nil {
+		t.Errorf("File should be drained after the quarantined file: %s", dest+"/file_B")
+	}
+}
@@ -0,0 +1,89 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"FileFlow/files"
+	"FileFlow/logging"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// RecoverTempFiles cleans the temporary files left in the destination and overflow folders of the flow by the
+// transfers interrupted by a crash. It should be called when the flow starts, before any transfer.
+// When the flow resumes its transfers, the temporary files of the source files still waiting for a transfer are kept,
+// so that their transfers resume from them. The other temporary files are removed.
+// The folders receiving files (of any flow sharing them) are skipped, as their temporary files are being written.
+// It returns the number of removed and kept temporary files.
+func RecoverTempFiles(flow *fileflows.FileFlow, sourceFiles FileList) (removed int, kept int, err error) {
+	logger := logging.ForFlow(flow.Name)
+	waiting := make(map[string]bool)
+	if resumes(flow) {
+		for _, file := range sourceFiles {
+			waiting[targetPath(flow, file.Path)] = true
+		}
+	}
+
+	folders := append(append([]string{}, flow.DestinationFolders...), flow.AllOverflowFolders()...)
+	for _, folder := range folders {
+		if pendingFiles, _ := inflight.pending(folder); pendingFiles > 0 {
+			logger.Debug("Skipping recovery of folder receiving files", "folder", folder)
+			continue
+		}
+
+		temps, err := listTempFiles(folder)
+		if err != nil {
+			return removed, kept, err
+		}
+
+		for _, tmp := range temps {
+			if waiting[files.TempFileTarget(tmp)] {
+				logger.Debug("Keeping partial file to resume its transfer", "file", ConcatFolderWithFile(folder, tmp))
+				kept++
+				continue
+			}
+
+			if err := os.Remove(filepath.Join(folder, tmp)); err != nil {
+				return removed, kept, err
+			}
+			logger.Debug("Removed orphaned temporary file", "file", ConcatFolderWithFile(folder, tmp))
+			removed++
+		}
+	}
+
+	return removed, kept, nil
+}
+
+// resumes tells if the transfers of the flow resume from their temporary files.
+// Only the moves from a SFTP server are resumed.
+func resumes(flow *fileflows.FileFlow) bool {
+	return flow.Resume && flow.IsRemote() && flow.Operation == fileflows.Move
+}
+
+// targetPath returns the path of the source file into the destination folders, relative to them.
+func targetPath(flow *fileflows.FileFlow, fileName string) string {
+	if flow.PreserveTree {
+		return fileName
+	}
+	return path.Base(fileName)
+}
+
+// listTempFiles returns the paths, relative to the folder, of the temporary files of the folder and its subfolders.
+// A folder that doesn't exist holds no temporary file.
+func listTempFiles(folder string) ([]string, error) {
+	var temps []string
+	err := fs.WalkDir(os.DirFS(folder), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && name == "." {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if d.Type().IsRegular() && files.IsTempFile(d.Name()) {
+			temps = append(temps, name)
+		}
+		return nil
+	})
+	return temps, err
+}
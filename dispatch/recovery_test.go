@@ -0,0 +1,118 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"FileFlow/files"
+	"context"
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestRecoverTempFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		resume  bool
+		removed int
+		kept    int
+	}{
+		{"Without resume", false, 3, 0},
+		{"With resume", true, 2, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			pattern := ".+"
+			dest := t.TempDir()
+			overflow := t.TempDir()
+			createFile(t, dest, "file_A")
+			createFile(t, dest, files.TempFile("file_B"))
+			createFile(t, dest, files.TempFile("file_C"))
+			createFile(t, overflow, files.TempFile("sub/file_D"))
+			flow := fileflows.FileFlow{Name: "Move ACME files", Server: "localhost", Port: 22, SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern), Operation: fileflows.Move, OverflowFolder: overflow, Resume: test.resume}
+			waiting := FileList{{Path: "file_B"}}
+
+			// When
+			removed, kept, err := RecoverTempFiles(&flow, waiting)
+
+			// Then
+			if err != nil {
+				t.Fatalf("Error recovering temporary files: %s", err)
+			}
+
+			if removed != test.removed || kept != test.kept {
+				t.Errorf("Expected %d removed and %d kept files, got %d and %d", test.removed, test.kept, removed, kept)
+			}
+
+			if _, err := os.Stat(dest + "/file_A"); err != nil {
+				t.Errorf("File should be found: %s", dest+"/file_A")
+			}
+
+			if _, err := os.Stat(files.TempFile(dest + "/file_B")); (err == nil) != test.resume {
+				t.Errorf("Partial file of file_B should be kept only with resume")
+			}
+
+			if files.ContainsFiles(overflow) {
+				t.Errorf("Overflow folder should be empty")
+			}
+		})
+	}
+}
+
+func TestRecoverTempFilesOfMissingFolder(t *testing.T) {
+	// Given
+	pattern := ".+"
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{t.TempDir() + "/missing"}, Regexp: regexp.MustCompile(pattern)}
+
+	// When
+	removed, kept, err := RecoverTempFiles(&flow, FileList{})
+
+	// Then
+	if err != nil || removed != 0 || kept != 0 {
+		t.Errorf("Expected nothing to recover, got %d removed, %d kept and error %v", removed, kept, err)
+	}
+}
+
+func TestRecoverTempFilesSkipsFolderReceivingFiles(t *testing.T) {
+	// Given
+	pattern := ".+"
+	dest := t.TempDir()
+	tmp := createFile(t, dest, files.TempFile("file_A"))
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{dest}, Regexp: regexp.MustCompile(pattern)}
+	release := inflight.reserve(dest, 21)
+	defer release()
+
+	// When
+	removed, _, err := RecoverTempFiles(&flow, FileList{})
+
+	// Then
+	if err != nil || removed != 0 {
+		t.Errorf("Expected nothing removed, got %d removed and error %v", removed, err)
+	}
+	if _, err := os.Stat(tmp); err != nil {
+		t.Errorf("File being transferred should be kept: %s", tmp)
+	}
+}
+
+func TestDispatchResumesIntoFolderWithPartialFile(t *testing.T) {
+	// Given
+	pattern := ".+"
+	dest1 := t.TempDir()
+	dest2 := t.TempDir()
+	createFile(t, dest2, files.TempFile("file_A"))
+	flow := fileflows.FileFlow{Name: "Move ACME files", Server: "localhost", Port: 22, SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{dest1, dest2}, Regexp: regexp.MustCompile(pattern), Operation: fileflows.Move, Resume: true}
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), noop)
+	dst, err := dispatcher.Dispatch(context.Background(), "file_A")
+
+	// Then
+	if err != nil {
+		t.Fatalf("Error dispatching file: %s", err)
+	}
+
+	if dst != dest2+"/file_A" {
+		t.Errorf("Expected destination: %s, got: %s", dest2+"/file_A", dst)
+	}
+}
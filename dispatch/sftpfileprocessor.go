@@ -2,18 +2,55 @@ package dispatch
 
 import (
 	"FileFlow/fileflows"
+	"FileFlow/files"
+	"FileFlow/logging"
+	"FileFlow/throttle"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"os"
 	"path"
-	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type SFTPFileProcessor struct {
-	client *ssh.Client
-	sftp   *sftp.Client
+	client       *ssh.Client
+	sftp         *sftp.Client
+	limiters     []*throttle.Limiter
+	resume       bool
+	verifyBytes  int64
+	chunkSize    int64
+	chunkWorkers int
+	committer
+}
+
+// defaultChunkSize is the size of the chunks of the flows downloading by chunks without chunk size setting.
+const defaultChunkSize = 16 << 20
+
+// newSFTPFileProcessor creates the processor of the flow on the SFTP connection.
+func newSFTPFileProcessor(client *ssh.Client, sc *sftp.Client, flow fileflows.FileFlow) SFTPFileProcessor {
+	chunkSize := flow.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
+	return SFTPFileProcessor{
+		client:       client,
+		sftp:         sc,
+		resume:       flow.Resume,
+		verifyBytes:  flow.ResumeVerifyBytes,
+		chunkSize:    chunkSize,
+		chunkWorkers: flow.ChunkWorkers,
+		committer:    committer{durable: flow.Durable, exclusive: !flow.PreserveTree, remote: true, logger: logging.ForFlow(flow.Name)},
+	}
 }
 
 // Close all resources about SFTP connection
@@ -25,36 +62,39 @@ func (p SFTPFileProcessor) Close() {
 
 // Connect to SFTP server and returns a SFTPFileProcessor for the provided flow.
 // flow parameter is the FileFlow description
+// The program exits if the connection fails. See SFTPPool for connections that survive the failures.
 func Connect(flow fileflows.FileFlow) SFTPFileProcessor {
-	client := sshClient(flow, flow.PrivateKeyPath)
-	sc := sftpClient(client)
-
-	processor := SFTPFileProcessor{
-		client,
-		sc,
+	client, sc, err := dial(flow)
+	if err != nil {
+		slog.Error("Cannot connect to SFTP server", "flow", flow.Name, "error", err)
+		os.Exit(1)
 	}
-	return processor
+
+	return newSFTPFileProcessor(client, sc, flow)
+}
+
+// Throttled returns a copy of the processor whose transfers are limited by the limiters.
+func (p SFTPFileProcessor) Throttled(limiters ...*throttle.Limiter) SFTPFileProcessor {
+	p.limiters = usedLimiters(limiters)
+	return p
+}
+
+// Journaled returns a copy of the processor whose deliveries are written into the journal.
+func (p SFTPFileProcessor) Journaled(journal *Journal) SFTPFileProcessor {
+	p.journal = journal
+	return p
 }
 
 // ListFiles list the files in the given directory that match the given pattern of the flow
 func (p SFTPFileProcessor) ListFiles(flow fileflows.FileFlow) FileList {
 	if _, err := p.sftp.Lstat(flow.SourceFolder); err != nil {
 		if os.IsNotExist(err) {
-			log.Printf("WARN source folder %s does not exist", flow.SourceFolder)
-			return []os.FileInfo{}
+			p.log().Warn("Source folder does not exist", "folder", flow.SourceFolder)
+			return FileList{}
 		}
 	}
 
-	walker := p.sftp.Walk(flow.SourceFolder)
-	var files = make(FileList, 0, 50)
-	for walker.Step() {
-		fileInfo := walker.Stat()
-		if !fileInfo.IsDir() && flow.Regexp.MatchString(fileInfo.Name()) {
-			files = append(files, fileInfo)
-		}
-	}
-	sort.Sort(files)
-	return files
+	return collectFiles(p.sftp.Walk(flow.SourceFolder), flow)
 }
 
 // ProcessFile do an action on a file from a SFTP server.
@@ -63,113 +103,345 @@ func (p SFTPFileProcessor) ListFiles(flow fileflows.FileFlow) FileList {
 // operation parameter is the operation to do
 //
 // After the operation is done, the file is moved to the destination folder (so, the file on the SFTP server is removed)
-func (p SFTPFileProcessor) ProcessFile(src string, dst string, operation fileflows.FlowOperation) error {
+func (p SFTPFileProcessor) ProcessFile(ctx context.Context, src string, dst string, operation fileflows.FlowOperation) error {
 
 	inp, err := p.sftp.Open(src)
 	if err != nil {
 		return err
 	}
 	defer inp.Close()
+	defer abortOnDone(ctx, inp)()
 
+	tmpDst, finalName := files.TempFile(dst), dst
 	if operation == fileflows.Move {
-		tmpDst := dst + ".tmp"
-		out, err := os.Create(tmpDst)
-		if err != nil {
-			return err
-		}
-		defer out.Close()
-		log.Printf("Moving %s to %s", src, dst)
-		err = copyFile(inp, out)
-		if err != nil {
+		p.log().Info("Moving file", "src", src, "dst", dst)
+		if err := p.download(ctx, inp, tmpDst); err != nil {
 			return fmt.Errorf("error copying file %s to %s: %v", src, tmpDst, err)
 		}
-		if err := os.Rename(tmpDst, dst); err != nil {
-			return fmt.Errorf("error renaming file %s to %s: %v", tmpDst, dst, err)
-		}
 
 	} else if operation == fileflows.Compression {
-		if err := compressOperation(src, dst, inp); err != nil {
+		if tmpDst, finalName, err = compressOperation(ctx, src, dst, throttle.Reader(ctx, inp, p.limiters...), p.log()); err != nil {
 			return err
 		}
 	} else if operation == fileflows.Decompression {
-		if err := uncompressOperation(src, dst, inp); err != nil {
+		if tmpDst, finalName, err = uncompressOperation(ctx, src, dst, throttle.Reader(ctx, inp, p.limiters...), p.log()); err != nil {
 			return err
 		}
 	}
 
-	_ = p.sftp.Remove(src)
-	log.Printf("Removed file %s", src)
+	return p.commit(src, tmpDst, finalName, p.RemoveSource)
+}
 
-	return nil
+// RemoveSource removes a source file from the SFTP server.
+func (p SFTPFileProcessor) RemoveSource(src string) error {
+	return p.sftp.Remove(src)
 }
 
 // OverflowFile move a file from SFTP to the overflow directory.
 // If success, dst contains the full path of the file in the local filesystem.
-func (p SFTPFileProcessor) OverflowFile(src string, overflowFolder string) (dst string, err error) {
+func (p SFTPFileProcessor) OverflowFile(ctx context.Context, src string, overflowFolder string) (dst string, err error) {
 	inp, err := p.sftp.Open(src)
 	if err != nil {
 		return "", fmt.Errorf("error opening file %s: %v", src, err)
 	}
 	defer inp.Close()
+	defer abortOnDone(ctx, inp)()
 
 	fileName := path.Base(src)
-	tmp := ConcatFolderWithFile(overflowFolder, fileName+".tmp")
-	out, err := os.Create(tmp)
-	if err != nil {
-		return "", fmt.Errorf("error creating file %s: %v", tmp, err)
-	}
-
-	if _, err := inp.WriteTo(out); err != nil {
+	tmp := files.TempFile(ConcatFolderWithFile(overflowFolder, fileName))
+	if err := p.download(ctx, inp, tmp); err != nil {
 		return "", fmt.Errorf("error copying file %s to %s: %v", src, tmp, err)
 	}
 
 	dst = ConcatFolderWithFile(overflowFolder, fileName)
-	if err := os.Rename(tmp, dst); err != nil {
-		return "", fmt.Errorf("error renaming file %s to %s: %v", tmp, dst, err)
+	if err := p.commit(src, tmp, dst, p.RemoveSource); err != nil {
+		return "", err
 	}
-
-	_ = p.sftp.Remove(src)
 	return dst, nil
 }
 
-func sshClient(flow fileflows.FileFlow, keyFile string) *ssh.Client {
+// sshTimeout bounds the connection to a SFTP server, handshake included.
+var sshTimeout = 30 * time.Second
+
+// defaultSFTPUser is the SFTP user of the flows without user setting.
+const defaultSFTPUser = "batman"
+
+// sftpUser returns the SFTP user of the flow.
+func sftpUser(flow fileflows.FileFlow) string {
+	if flow.User == "" {
+		return defaultSFTPUser
+	}
+	return flow.User
+}
+
+// dial opens an SSH connection to the SFTP server of the flow and starts a SFTP session on it.
+func dial(flow fileflows.FileFlow) (*ssh.Client, *sftp.Client, error) {
+	client, err := sshClient(flow, flow.PrivateKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		_ = client.Close()
+		return nil, nil, fmt.Errorf("failed to sftp: %w", err)
+	}
+	return client, sc, nil
+}
+
+func sshClient(flow fileflows.FileFlow, keyFile string) (*ssh.Client, error) {
 	key, err := os.ReadFile(keyFile)
 	if err != nil {
-		log.Fatalf("unable to read private key: %v", err)
+		return nil, fmt.Errorf("unable to read private key: %w", err)
 	}
 	signer, err := ssh.ParsePrivateKey(key)
 	if err != nil {
-		log.Fatalf("unable to parse private key: %v", err)
+		return nil, fmt.Errorf("unable to parse private key: %w", err)
 	}
 
 	config := &ssh.ClientConfig{
-		User: "batman",
+		User: sftpUser(flow),
 		Auth: []ssh.AuthMethod{
 			ssh.PublicKeys(signer),
 		},
 		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         sshTimeout,
 	}
 
-	addr := fmt.Sprintf("%s:%d", flow.Server, flow.Port)
-	client, err := ssh.Dial("tcp", addr, config)
+	// The handshake is bounded too, as a server may accept the connection without answering.
+	addr := net.JoinHostPort(flow.Server, strconv.Itoa(flow.Port))
+	conn, err := net.DialTimeout("tcp", addr, config.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+	if err := conn.SetDeadline(time.Now().Add(sshTimeout)); err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
 	if err != nil {
-		log.Fatal("Failed to dial: ", err)
+		_ = conn.Close()
+		return nil, fmt.Errorf("failed to dial: %w", err)
 	}
-	return client
+	_ = conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
-func sftpClient(client *ssh.Client) *sftp.Client {
-	sc, err := sftp.NewClient(client)
+// download copies the SFTP file into the local tmp file.
+// When the processor resumes the transfers, a tmp file left by an interrupted transfer is completed instead of being
+// downloaded again, and the valid part of the tmp file is kept if the transfer fails again. Otherwise, the tmp file is
+// removed on error.
+// The files bigger than a chunk are downloaded by chunks at the same time when the flow sets many chunk workers.
+func (p SFTPFileProcessor) download(ctx context.Context, inp *sftp.File, tmp string) error {
+	var offset int64
+	if p.resume {
+		var err error
+		if offset, err = p.resumeOffset(inp, tmp); err != nil {
+			return err
+		}
+		if offset > 0 {
+			p.log().Debug("Resuming transfer", "file", inp.Name(), "offset", offset)
+		}
+	}
+
+	flag := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flag |= os.O_TRUNC
+	}
+	out, err := os.OpenFile(tmp, flag, 0666)
 	if err != nil {
-		log.Fatal("Failed to sftp: ", err)
+		return err
+	}
+	defer out.Close()
+
+	if p.chunkWorkers > 1 {
+		remote, err := inp.Stat()
+		if err != nil {
+			return err
+		}
+		if remote.Size()-offset > p.chunkSize {
+			err := copyChunks(ctx, inp, out, offset, remote.Size(), p.chunkSize, p.chunkWorkers, p.limiters)
+			if err != nil {
+				p.discard(tmp, offset)
+				return err
+			}
+			return digestFile(ctx, tmp)
+		}
 	}
-	return sc
-}
 
-func copyFile(inp *sftp.File, out *os.File) error {
-	if _, err := inp.WriteTo(out); err != nil {
+	if _, err := inp.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := out.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	// The hash of a resumed download is computed from the whole tmp file, as its first part isn't downloaded again.
+	var w io.Writer = out
+	digested := func() {}
+	if offset == 0 {
+		w, digested = digestWriter(ctx, out)
+	}
+	if err := copyFile(ctx, inp, w, p.limiters); err != nil {
 		_ = out.Close()
+		if !p.resume {
+			_ = os.Remove(tmp)
+		}
 		return err
 	}
+	digested()
+	if offset > 0 {
+		return digestFile(ctx, tmp)
+	}
 	return nil
 }
+
+// discard removes the tmp file of a failed download by chunks. When the processor resumes the transfers, only the
+// bytes written by the chunks are removed, as the tmp file may hold holes.
+func (p SFTPFileProcessor) discard(tmp string, offset int64) {
+	if p.resume && offset > 0 {
+		_ = os.Truncate(tmp, offset)
+		return
+	}
+	_ = os.Remove(tmp)
+}
+
+// resumeOffset returns the offset where the transfer of the SFTP file into the tmp file can resume, 0 if it must
+// restart from the beginning.
+// The tmp file is a valid prefix of the SFTP file if it isn't bigger than the SFTP file and, when the processor
+// verifies the prefixes, if its last bytes are the same as the bytes of the SFTP file at the same offset.
+// A tmp file as big as the SFTP file is verified completely: a download by chunks preallocates the tmp file, which
+// holds holes where the chunks weren't written when the download was interrupted.
+func (p SFTPFileProcessor) resumeOffset(inp *sftp.File, tmp string) (int64, error) {
+	partial, err := os.Stat(tmp)
+	if err != nil || partial.Size() == 0 {
+		return 0, nil
+	}
+
+	remote, err := inp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if partial.Size() > remote.Size() {
+		p.log().Warn("Partial file is bigger than the source file, the transfer restarts", "file", inp.Name(), "tmp", tmp)
+		return 0, nil
+	}
+
+	verifyBytes := p.verifyBytes
+	if partial.Size() == remote.Size() {
+		verifyBytes = partial.Size()
+	}
+	if verifyBytes > 0 {
+		same, err := sameTail(inp, tmp, partial.Size(), verifyBytes)
+		if err != nil {
+			return 0, err
+		}
+		if !same {
+			p.log().Warn("Partial file doesn't match the source file, the transfer restarts", "file", inp.Name(), "tmp", tmp)
+			return 0, nil
+		}
+	}
+
+	return partial.Size(), nil
+}
+
+// sameTail tells whether the last n bytes (at most) of the first size bytes are the same in the SFTP file and in the
+// local file.
+func sameTail(inp *sftp.File, local string, size int64, n int64) (bool, error) {
+	if n > size {
+		n = size
+	}
+	offset := size - n
+
+	f, err := os.Open(local)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	localHash, err := hashAt(f, offset, n)
+	if err != nil {
+		return false, err
+	}
+	remoteHash, err := hashAt(inp, offset, n)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(localHash, remoteHash), nil
+}
+
+// hashAt returns the SHA-256 hash of the n bytes at the offset.
+func hashAt(r io.ReaderAt, offset int64, n int64) ([]byte, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, offset, n)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// copyChunks copies the bytes of the SFTP file from the offset to the size into the local file, by chunks of
+// chunkSize bytes. The chunks are copied by many workers at the same time into the preallocated local file.
+func copyChunks(ctx context.Context, inp *sftp.File, out *os.File, offset int64, size int64, chunkSize int64,
+	workers int, limiters []*throttle.Limiter) error {
+	if err := out.Truncate(size); err != nil {
+		return err
+	}
+
+	var once sync.Once
+	var firstErr error
+	failed := make(chan struct{})
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(failed)
+		})
+	}
+
+	chunks := make(chan int64)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range chunks {
+				n := chunkSize
+				if start+n > size {
+					n = size - start
+				}
+				r := throttle.Reader(ctx, io.NewSectionReader(inp, start, n), limiters...)
+				written, err := io.Copy(io.NewOffsetWriter(out, start), r)
+				if err == nil && written < n {
+					err = io.ErrUnexpectedEOF
+				}
+				if err != nil {
+					fail(fmt.Errorf("chunk at byte %d: %w", start, err))
+					return
+				}
+			}
+		}()
+	}
+
+feed:
+	for start := offset; start < size; start += chunkSize {
+		select {
+		case chunks <- start:
+		case <-failed:
+			break feed
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	return firstErr
+}
+
+// copyFile copies the SFTP file into the local file.
+// Without limiter, the fast concurrent reads of the SFTP file are used.
+func copyFile(ctx context.Context, inp *sftp.File, out io.Writer, limiters []*throttle.Limiter) error {
+	var err error
+	if len(limiters) > 0 {
+		_, err = io.Copy(out, throttle.Reader(ctx, inp, limiters...))
+	} else {
+		_, err = inp.WriteTo(out)
+	}
+	return err
+}
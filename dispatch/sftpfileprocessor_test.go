@@ -0,0 +1,185 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"FileFlow/files"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSFTPProcessFileResume(t *testing.T) {
+	tests := []struct {
+		name        string
+		resume      bool
+		verifyBytes int64
+		partial     string
+		expected    string
+	}{
+		{"Without resume", false, 0, "0123XYZ", "0123456789abcdef"},
+		{"Resume from the partial file", true, 0, "0123XYZ", "0123XYZ789abcdef"},
+		{"Resume with verified partial file", true, 4, "0123456", "0123456789abcdef"},
+		{"Restart when partial file mismatches", true, 4, "0123XYZ", "0123456789abcdef"},
+		{"Restart when partial file is too big", true, 0, "0123456789abcdef+", "0123456789abcdef"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			sourceFolder := t.TempDir()
+			destination := t.TempDir()
+			_, flow := startSFTPServer(t, sourceFolder, destination)
+			flow.Resume = test.resume
+			flow.ResumeVerifyBytes = test.verifyBytes
+
+			src := filepath.Join(sourceFolder, "acme.txt")
+			dst := filepath.Join(destination, "acme.txt")
+			if err := os.WriteFile(src, []byte("0123456789abcdef"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(files.TempFile(dst), []byte(test.partial), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			processor := Connect(flow)
+			defer processor.Close()
+
+			// When
+			ctx, digest := withDigest(context.Background())
+			err := processor.ProcessFile(ctx, src, dst, fileflows.Move)
+
+			// Then
+			if err != nil {
+				t.Fatalf("Error processing file: %s", err)
+			}
+
+			content, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatalf("Error reading destination file: %s", err)
+			}
+			if string(content) != test.expected {
+				t.Errorf("Expected %s, got %s", test.expected, content)
+			}
+			if hash := sha256.Sum256(content); digest.Sum() != hex.EncodeToString(hash[:]) {
+				t.Errorf("Expected hash %x, got %s", hash, digest.Sum())
+			}
+
+			if _, err := os.Stat(files.TempFile(dst)); !os.IsNotExist(err) {
+				t.Errorf("Expected tmp file to be removed")
+			}
+		})
+	}
+}
+
+func TestSFTPProcessFileByChunks(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		chunkSize int64
+		partial   int
+	}{
+		{"Small file in a single stream", 100, 1000, 0},
+		{"File by chunks", 10000, 1000, 0},
+		{"Last chunk shorter", 10500, 1000, 0},
+		{"Resumed file by chunks", 10500, 1000, 2500},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			sourceFolder := t.TempDir()
+			destination := t.TempDir()
+			_, flow := startSFTPServer(t, sourceFolder, destination)
+			flow.ChunkSize = test.chunkSize
+			flow.ChunkWorkers = 4
+			flow.Resume = test.partial > 0
+
+			data := make([]byte, test.size)
+			for i := range data {
+				data[i] = byte(i % 251)
+			}
+			src := filepath.Join(sourceFolder, "acme.bin")
+			dst := filepath.Join(destination, "acme.bin")
+			if err := os.WriteFile(src, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if test.partial > 0 {
+				if err := os.WriteFile(files.TempFile(dst), data[:test.partial], 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			processor := Connect(flow)
+			defer processor.Close()
+
+			// When
+			ctx, digest := withDigest(context.Background())
+			err := processor.ProcessFile(ctx, src, dst, fileflows.Move)
+
+			// Then
+			if err != nil {
+				t.Fatalf("Error processing file: %s", err)
+			}
+
+			content, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatalf("Error reading destination file: %s", err)
+			}
+			if !bytes.Equal(content, data) {
+				t.Errorf("Expected the destination file to be the same as the source file")
+			}
+			if hash := sha256.Sum256(content); digest.Sum() != hex.EncodeToString(hash[:]) {
+				t.Errorf("Expected hash %x, got %s", hash, digest.Sum())
+			}
+		})
+	}
+}
+
+func TestSFTPResumeAfterInterruptedDownloadByChunks(t *testing.T) {
+	// Given
+	sourceFolder := t.TempDir()
+	destination := t.TempDir()
+	_, flow := startSFTPServer(t, sourceFolder, destination)
+	flow.ChunkSize = 1000
+	flow.ChunkWorkers = 4
+	flow.Resume = true
+
+	data := make([]byte, 10500)
+	for i := range data {
+		data[i] = byte(i%251 + 1)
+	}
+	src := filepath.Join(sourceFolder, "acme.bin")
+	dst := filepath.Join(destination, "acme.bin")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The preallocated tmp file of the interrupted download: the chunk at byte 3000 was never written.
+	partial := append([]byte{}, data...)
+	copy(partial[3000:4000], make([]byte, 1000))
+	if err := os.WriteFile(files.TempFile(dst), partial, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	processor := Connect(flow)
+	defer processor.Close()
+
+	// When
+	err := processor.ProcessFile(context.Background(), src, dst, fileflows.Move)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Error processing file: %s", err)
+	}
+
+	content, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("Error reading destination file: %s", err)
+	}
+	if !bytes.Equal(content, data) {
+		t.Errorf("Expected the destination file to be the same as the source file")
+	}
+}
@@ -0,0 +1,140 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"fmt"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// SFTPPool keeps the SFTP connections open between the flow cycles.
+// The flows targeting the same server with the same user and private key share the same connection.
+// The connections are kept alive, checked before being used and opened again when they are broken.
+type SFTPPool struct {
+	keepAlive time.Duration
+
+	mu    sync.Mutex
+	conns map[poolKey]*pooledConn
+	// dials serializes the checks and the dials of the connection of each key, so that a slow server only delays
+	// its own flows.
+	dials map[poolKey]*sync.Mutex
+}
+
+type poolKey struct {
+	addr string
+	user string
+	key  string
+}
+
+type pooledConn struct {
+	client *ssh.Client
+	sftp   *sftp.Client
+	done   chan struct{}
+	once   sync.Once
+}
+
+// NewSFTPPool creates an empty pool. The connections are kept alive by a request sent every keepAlive.
+// A zero keepAlive disables the keepalive requests.
+func NewSFTPPool(keepAlive time.Duration) *SFTPPool {
+	return &SFTPPool{
+		keepAlive: keepAlive,
+		conns:     map[poolKey]*pooledConn{},
+		dials:     map[poolKey]*sync.Mutex{},
+	}
+}
+
+// Get returns a SFTPFileProcessor for the flow using a pooled connection.
+// A new connection is opened if there is none for the server of the flow or if it's broken.
+// The processor must not be closed: its connection belongs to the pool.
+// The connection is checked and opened without locking the pool: the flows of the other servers aren't delayed.
+func (p *SFTPPool) Get(flow fileflows.FileFlow) (SFTPFileProcessor, error) {
+	key := poolKey{fmt.Sprintf("%s:%d", flow.Server, flow.Port), sftpUser(flow), flow.PrivateKeyPath}
+
+	p.mu.Lock()
+	dialing, ok := p.dials[key]
+	if !ok {
+		dialing = &sync.Mutex{}
+		p.dials[key] = dialing
+	}
+	p.mu.Unlock()
+
+	dialing.Lock()
+	defer dialing.Unlock()
+
+	p.mu.Lock()
+	conn, ok := p.conns[key]
+	p.mu.Unlock()
+	if ok {
+		if _, err := conn.sftp.Getwd(); err == nil {
+			return newSFTPFileProcessor(conn.client, conn.sftp, flow), nil
+		}
+
+		slog.Warn("SFTP connection is broken, reconnecting", "server", key.addr, "user", key.user)
+		p.mu.Lock()
+		p.remove(key, conn)
+		p.mu.Unlock()
+	}
+
+	client, sc, err := dial(flow)
+	if err != nil {
+		return SFTPFileProcessor{}, err
+	}
+
+	conn = &pooledConn{client: client, sftp: sc, done: make(chan struct{})}
+	p.mu.Lock()
+	p.conns[key] = conn
+	p.mu.Unlock()
+	if p.keepAlive > 0 {
+		go p.keepConnAlive(key, conn)
+	}
+
+	return newSFTPFileProcessor(client, sc, flow), nil
+}
+
+// Close closes all the connections of the pool.
+func (p *SFTPPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, conn := range p.conns {
+		p.remove(key, conn)
+	}
+}
+
+// keepConnAlive sends keepalive requests on the connection until it's closed.
+// A connection that doesn't answer is removed from the pool.
+func (p *SFTPPool) keepConnAlive(key poolKey, conn *pooledConn) {
+	ticker := time.NewTicker(p.keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.done:
+			return
+		case <-ticker.C:
+			if _, _, err := conn.client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				slog.Warn("SFTP connection is lost", "server", key.addr, "user", key.user, "error", err)
+				p.mu.Lock()
+				p.remove(key, conn)
+				p.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// remove closes the connection and removes it from the pool if it's still there. The pool must be locked.
+func (p *SFTPPool) remove(key poolKey, conn *pooledConn) {
+	if p.conns[key] == conn {
+		delete(p.conns, key)
+	}
+
+	conn.once.Do(func() {
+		close(conn.done)
+		_ = conn.sftp.Close()
+		_ = conn.client.Close()
+	})
+}
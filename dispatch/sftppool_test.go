@@ -0,0 +1,133 @@
+package dispatch
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSFTPPoolSharesConnections(t *testing.T) {
+	// Given
+	server, flow := startSFTPServer(t, t.TempDir(), t.TempDir())
+	other := flow
+	other.Name = "Move other ACME files"
+	pool := NewSFTPPool(0)
+	defer pool.Close()
+
+	// When
+	first, err := pool.Get(flow)
+	if err != nil {
+		t.Fatalf("Error getting connection: %s", err)
+	}
+	second, err := pool.Get(other)
+	if err != nil {
+		t.Fatalf("Error getting connection: %s", err)
+	}
+
+	// Then
+	if first.sftp != second.sftp {
+		t.Errorf("Expected the flows to share the connection")
+	}
+
+	if server.dialCount() != 1 {
+		t.Errorf("Expected 1 connection, got %d", server.dialCount())
+	}
+}
+
+func TestSFTPPoolReconnects(t *testing.T) {
+	// Given
+	server, flow := startSFTPServer(t, t.TempDir(), t.TempDir())
+	pool := NewSFTPPool(0)
+	defer pool.Close()
+	if _, err := pool.Get(flow); err != nil {
+		t.Fatalf("Error getting connection: %s", err)
+	}
+
+	// When
+	server.dropConnections()
+	processor, err := pool.Get(flow)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Error getting connection: %s", err)
+	}
+
+	if _, err := processor.sftp.Getwd(); err != nil {
+		t.Errorf("Expected a working connection, got %s", err)
+	}
+
+	if server.dialCount() != 2 {
+		t.Errorf("Expected 2 connections, got %d", server.dialCount())
+	}
+}
+
+func TestSFTPPoolFailure(t *testing.T) {
+	// Given
+	_, flow := startSFTPServer(t, t.TempDir(), t.TempDir())
+	flow.PrivateKeyPath = flow.PrivateKeyPath + ".missing"
+	pool := NewSFTPPool(0)
+	defer pool.Close()
+
+	// When
+	_, err := pool.Get(flow)
+
+	// Then
+	if err == nil {
+		t.Errorf("Expected error, got nothing")
+	}
+}
+
+func TestSFTPPoolDoesNotWaitForSilentServer(t *testing.T) {
+	defer func(timeout time.Duration) { sshTimeout = timeout }(sshTimeout)
+	sshTimeout = 500 * time.Millisecond
+
+	// Given
+	_, flow := startSFTPServer(t, t.TempDir(), t.TempDir())
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan struct{})
+	go func() {
+		// The server accepts the connection but never answers.
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		close(accepted)
+	}()
+	silent := flow
+	silent.Name = "Move Wayne files"
+	silent.Port = listener.Addr().(*net.TCPAddr).Port
+	pool := NewSFTPPool(0)
+	defer pool.Close()
+
+	// When
+	silentErr := make(chan error, 1)
+	go func() {
+		_, err := pool.Get(silent)
+		silentErr <- err
+	}()
+	<-accepted
+	start := time.Now()
+	_, err = pool.Get(flow)
+	elapsed := time.Since(start)
+
+	// Then
+	if err != nil {
+		t.Fatalf("Error getting connection: %s", err)
+	}
+	if elapsed >= sshTimeout {
+		t.Errorf("Expected the connection not to wait for the silent server, got %s", elapsed)
+	}
+	select {
+	case err := <-silentErr:
+		if err == nil {
+			t.Errorf("Expected the connection to the silent server to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the connection to the silent server to time out")
+	}
+}
@@ -0,0 +1,147 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+// testSFTPServer is an in-process SFTP server serving the local filesystem.
+type testSFTPServer struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn
+	dials int
+}
+
+// startSFTPServer starts a SFTP server and returns a flow reading the source folder on it.
+func startSFTPServer(t *testing.T, sourceFolder string, destinations ...string) (*testSFTPServer, fileflows.FileFlow) {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, userKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(userKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := path.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, _ ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testSFTPServer{listener: listener}
+	t.Cleanup(server.close)
+	go server.serve(config)
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	pattern := ".+"
+	flow := fileflows.FileFlow{Name: "Move ACME files", Server: "127.0.0.1", Port: port, User: "batman",
+		PrivateKeyPath: keyFile, SourceFolder: sourceFolder, Pattern: pattern, DestinationFolders: destinations,
+		Regexp: regexp.MustCompile(pattern), Operation: fileflows.Move}
+	return server, flow
+}
+
+func (s *testSFTPServer) serve(config *ssh.ServerConfig) {
+	for {
+		nConn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		conn, chans, reqs, err := ssh.NewServerConn(nConn, config)
+		if err != nil {
+			continue
+		}
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.dials++
+		s.mu.Unlock()
+
+		go ssh.DiscardRequests(reqs)
+		go serveChannels(chans)
+	}
+}
+
+func serveChannels(chans <-chan ssh.NewChannel) {
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						_ = channel.Close()
+						return
+					}
+					_ = server.Serve()
+					_ = channel.Close()
+				}
+			}
+		}()
+	}
+}
+
+// dropConnections closes all the connections opened to the server.
+func (s *testSFTPServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+// dialCount returns the number of connections opened to the server.
+func (s *testSFTPServer) dialCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dials
+}
+
+func (s *testSFTPServer) close() {
+	_ = s.listener.Close()
+	s.dropConnections()
+}
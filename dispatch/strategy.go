@@ -0,0 +1,201 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"FileFlow/files"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+// Strategy chooses the destination folders where a file may be dispatched.
+// A Strategy lives as long as its flow, so it can keep a state between the flow cycles.
+// The Dispatcher never calls a Strategy from many goroutines at the same time.
+type Strategy interface {
+	// Candidates returns the destination folders to try for the file, by order of preference.
+	// The folders parameter is the list of the destination folders of the flow.
+	Candidates(file SourceFile, folders []string) []string
+
+	// Dispatched is called when the folder is chosen for the file, before the file is processed.
+	Dispatched(file SourceFile, folder string)
+}
+
+// StrategyBuilder creates the Strategy of a flow.
+type StrategyBuilder func(flow *fileflows.FileFlow) (Strategy, error)
+
+var (
+	strategiesMu sync.RWMutex
+	strategies   = map[string]StrategyBuilder{
+		"":                   roundRobinBuilder,
+		"round_robin":        roundRobinBuilder,
+		"least_loaded":       leastLoadedBuilder(false),
+		"least_loaded_bytes": leastLoadedBuilder(true),
+		"weighted":           newWeighted,
+		"hash":               newHashSticky,
+	}
+)
+
+// RegisterStrategy makes a Strategy available under the name for the strategy setting of the flows.
+// It replaces any strategy already registered with the same name.
+func RegisterStrategy(name string, builder StrategyBuilder) {
+	strategiesMu.Lock()
+	defer strategiesMu.Unlock()
+	strategies[name] = builder
+}
+
+// NewStrategy creates the Strategy set in the flow.
+// The default strategy is the round-robin.
+func NewStrategy(flow *fileflows.FileFlow) (Strategy, error) {
+	strategiesMu.RLock()
+	builder, ok := strategies[flow.Strategy]
+	strategiesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown dispatch strategy %q", flow.Strategy)
+	}
+	return builder(flow)
+}
+
+// RoundRobin returns a Strategy using the destination folders one after the other.
+func RoundRobin() Strategy {
+	return &roundRobin{}
+}
+
+func roundRobinBuilder(_ *fileflows.FileFlow) (Strategy, error) {
+	return RoundRobin(), nil
+}
+
+type roundRobin struct {
+	folders []string
+	offset  int
+}
+
+func (s *roundRobin) Candidates(_ SourceFile, folders []string) []string {
+	s.folders = folders
+	if s.offset >= len(folders) {
+		s.offset = 0
+	}
+	return append(append([]string{}, folders[s.offset:]...), folders[:s.offset]...)
+}
+
+// Dispatched makes the next file start from the folder following the one used.
+func (s *roundRobin) Dispatched(_ SourceFile, folder string) {
+	for i, f := range s.folders {
+		if f == folder {
+			s.offset = i + 1
+			return
+		}
+	}
+}
+
+// leastLoaded prefers the destination folders with the fewest files (or bytes).
+type leastLoaded struct {
+	byBytes bool
+}
+
+func leastLoadedBuilder(byBytes bool) StrategyBuilder {
+	return func(_ *fileflows.FileFlow) (Strategy, error) {
+		return leastLoaded{byBytes}, nil
+	}
+}
+
+func (s leastLoaded) Candidates(_ SourceFile, folders []string) []string {
+	loads := make(map[string]int64, len(folders))
+	for _, folder := range folders {
+		if s.byBytes {
+			loads[folder] = files.FolderSize(folder)
+		} else {
+			loads[folder] = int64(files.CountFiles(folder))
+		}
+	}
+
+	candidates := append([]string{}, folders...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return loads[candidates[i]] < loads[candidates[j]]
+	})
+	return candidates
+}
+
+func (s leastLoaded) Dispatched(_ SourceFile, _ string) {
+}
+
+// weighted distributes the files across the destination folders according to the flow weights.
+// It's a smooth weighted round-robin: with the weights 2 and 1, the files go to the folders 1, 2, 1, 1, 2, 1...
+type weighted struct {
+	weights map[string]int
+	current map[string]int
+	total   int
+}
+
+func newWeighted(flow *fileflows.FileFlow) (Strategy, error) {
+	if len(flow.Weights) != len(flow.DestinationFolders) {
+		return nil, fmt.Errorf("weighted strategy needs one weight per destination folder, got %d weights for %d folders",
+			len(flow.Weights), len(flow.DestinationFolders))
+	}
+
+	s := weighted{weights: map[string]int{}, current: map[string]int{}}
+	for i, folder := range flow.DestinationFolders {
+		if flow.Weights[i] <= 0 {
+			return nil, fmt.Errorf("weight of destination folder %s must be positive", folder)
+		}
+		s.weights[folder] = flow.Weights[i]
+		s.total += flow.Weights[i]
+	}
+	return &s, nil
+}
+
+func (s *weighted) Candidates(_ SourceFile, folders []string) []string {
+	candidates := append([]string{}, folders...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return s.current[candidates[i]]+s.weights[candidates[i]] > s.current[candidates[j]]+s.weights[candidates[j]]
+	})
+	return candidates
+}
+
+func (s *weighted) Dispatched(_ SourceFile, folder string) {
+	for f, w := range s.weights {
+		s.current[f] += w
+	}
+	s.current[folder] -= s.total
+}
+
+// hashSticky sends the files sharing the same key into the same destination folder.
+// The key is a capture group of the flow pattern (or the file name without group).
+// A rendezvous hashing is used, so adding a folder only moves the keys that go to the new folder.
+type hashSticky struct {
+	flow  *fileflows.FileFlow
+	group int
+}
+
+func newHashSticky(flow *fileflows.FileFlow) (Strategy, error) {
+	group, err := captureGroup(flow, flow.HashGroup)
+	if err != nil {
+		return nil, fmt.Errorf("hash group: %w", err)
+	}
+	return hashSticky{flow, group}, nil
+}
+
+// Candidates returns only one folder: the files of a key must never go elsewhere.
+func (s hashSticky) Candidates(file SourceFile, folders []string) []string {
+	key := s.key(file)
+
+	var best string
+	var bestScore uint64
+	for _, folder := range folders {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(folder))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(key))
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = folder, score
+		}
+	}
+	return []string{best}
+}
+
+func (s hashSticky) key(file SourceFile) string {
+	return groupValue(s.flow, s.group, file)
+}
+
+func (s hashSticky) Dispatched(_ SourceFile, _ string) {
+}
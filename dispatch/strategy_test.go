@@ -0,0 +1,165 @@
+package dispatch
+
+import (
+	"FileFlow/fileflows"
+	"context"
+	"regexp"
+	"testing"
+)
+
+func TestWeightedStrategy(t *testing.T) {
+	// Given
+	pattern := ".+"
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/dest1", "/dest2"}, Regexp: regexp.MustCompile(pattern), Strategy: "weighted", Weights: []int{2, 1}}
+	strategy, err := NewStrategy(&flow)
+	if err != nil {
+		t.Fatalf("Error creating strategy: %s", err)
+	}
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), noop).WithStrategy(strategy)
+	var got []string
+	for _, name := range []string{"file_A", "file_B", "file_C", "file_D", "file_E", "file_F"} {
+		dst, err := dispatcher.Dispatch(context.Background(), name)
+		if err != nil {
+			t.Fatalf("Error dispatching file: %s", err)
+		}
+		got = append(got, dst)
+	}
+
+	// Then
+	expected := []string{"/dest1/file_A", "/dest2/file_B", "/dest1/file_C", "/dest1/file_D", "/dest2/file_E", "/dest1/file_F"}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected destination: %s, got: %s", expected[i], got[i])
+		}
+	}
+}
+
+func TestWeightedStrategyNeedsOneWeightPerFolder(t *testing.T) {
+	// Given
+	flow := fileflows.FileFlow{Name: "Move ACME files", DestinationFolders: []string{"/dest1", "/dest2"}, Strategy: "weighted", Weights: []int{2}}
+
+	// When
+	_, err := NewStrategy(&flow)
+
+	// Then
+	if err == nil {
+		t.Errorf("Expected error, got nothing")
+	}
+}
+
+func TestHashStickyStrategy(t *testing.T) {
+	// Given
+	pattern := `^(?P<customer>[a-z]+)_\d+\.csv$`
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/dest1", "/dest2", "/dest3"}, Regexp: regexp.MustCompile(pattern), Strategy: "hash", HashGroup: "customer"}
+	strategy, err := NewStrategy(&flow)
+	if err != nil {
+		t.Fatalf("Error creating strategy: %s", err)
+	}
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), noop).WithStrategy(strategy)
+	folders := map[string]string{}
+	for _, name := range []string{"acme_1.csv", "wayne_1.csv", "acme_2.csv", "stark_1.csv", "wayne_2.csv", "acme_3.csv"} {
+		dst, err := dispatcher.Dispatch(context.Background(), name)
+		if err != nil {
+			t.Fatalf("Error dispatching file: %s", err)
+		}
+
+		// Then
+		key := flow.Regexp.FindStringSubmatch(name)[1]
+		folder := dst[:len("/destN")]
+		if previous, ok := folders[key]; ok && previous != folder {
+			t.Errorf("Expected files of %s into %s, got %s", key, previous, dst)
+		}
+		folders[key] = folder
+	}
+}
+
+func TestHashStickyStrategyWithUnknownGroup(t *testing.T) {
+	// Given
+	pattern := `^([a-z]+)_\d+\.csv$`
+	flow := fileflows.FileFlow{Name: "Move ACME files", Pattern: pattern, DestinationFolders: []string{"/dest1"}, Regexp: regexp.MustCompile(pattern), Strategy: "hash", HashGroup: "2"}
+
+	// When
+	_, err := NewStrategy(&flow)
+
+	// Then
+	if err == nil {
+		t.Errorf("Expected error, got nothing")
+	}
+}
+
+func TestLeastLoadedStrategy(t *testing.T) {
+	// Given
+	loaded := t.TempDir()
+	createFile(t, loaded, "file_A")
+	empty := t.TempDir()
+	pattern := ".+"
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{loaded, empty}, Regexp: regexp.MustCompile(pattern), Strategy: "least_loaded"}
+	strategy, err := NewStrategy(&flow)
+	if err != nil {
+		t.Fatalf("Error creating strategy: %s", err)
+	}
+
+	// When
+	dispatcher := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), noop).WithStrategy(strategy)
+	dst, err := dispatcher.Dispatch(context.Background(), "file_B")
+
+	// Then
+	if err != nil {
+		t.Errorf("Error dispatching file: %s", err)
+	}
+
+	if dst != empty+"/file_B" {
+		t.Errorf("Expected destination: %s, got: %s", empty+"/file_B", dst)
+	}
+}
+
+func TestRegisterStrategy(t *testing.T) {
+	// Given
+	RegisterStrategy("last_first", func(_ *fileflows.FileFlow) (Strategy, error) {
+		return lastFirst{}, nil
+	})
+	pattern := ".+"
+	flow := fileflows.FileFlow{Name: "Move ACME files", SourceFolder: "acme", Pattern: pattern, DestinationFolders: []string{"/dest1", "/dest2"}, Regexp: regexp.MustCompile(pattern), Strategy: "last_first"}
+
+	// When
+	strategy, err := NewStrategy(&flow)
+	if err != nil {
+		t.Fatalf("Error creating strategy: %s", err)
+	}
+	dst, err := NewDispatcher(&flow, new(mockAlwaysTrueFolderAvailability), noop).WithStrategy(strategy).Dispatch(context.Background(), "file_A")
+
+	// Then
+	if err != nil {
+		t.Errorf("Error dispatching file: %s", err)
+	}
+
+	if dst != "/dest2/file_A" {
+		t.Errorf("Expected destination: %s, got: %s", "/dest2/file_A", dst)
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	// Given
+	flow := fileflows.FileFlow{Name: "Move ACME files", DestinationFolders: []string{"/dest1"}, Strategy: "random"}
+
+	// When
+	_, err := NewStrategy(&flow)
+
+	// Then
+	if err == nil {
+		t.Errorf("Expected error, got nothing")
+	}
+}
+
+type lastFirst struct{}
+
+func (s lastFirst) Candidates(_ SourceFile, folders []string) []string {
+	return []string{folders[len(folders)-1]}
+}
+
+func (s lastFirst) Dispatched(_ SourceFile, _ string) {
+}
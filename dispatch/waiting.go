@@ -0,0 +1,67 @@
+package dispatch
+
+import (
+	"sync"
+)
+
+// WaitingFiles remembers the files of a flow left in their source folder without transfer (no available folder or
+// rejected), so that they are reported once and not at each cycle while they wait. The files are known by their path
+// relative to the source folder.
+// A WaitingFiles may be used by many goroutines at the same time. A nil WaitingFiles remembers nothing: the files are
+// reported at each dispatch.
+type WaitingFiles struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+// NewWaitingFiles creates an empty WaitingFiles. The same one should be given to all the dispatchers of a flow.
+func NewWaitingFiles() *WaitingFiles {
+	return &WaitingFiles{files: map[string]string{}}
+}
+
+// Keep forgets the files that are not in the list of the files of the source folder anymore.
+func (w *WaitingFiles) Keep(paths []string) {
+	if w == nil {
+		return
+	}
+
+	listed := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		listed[path] = true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for path := range w.files {
+		if !listed[path] {
+			delete(w.files, path)
+		}
+	}
+}
+
+// wait records that the file waits for the reason, and tells if it must be reported: the file wasn't waiting or was
+// waiting for another reason.
+func (w *WaitingFiles) wait(path string, reason string) bool {
+	if w == nil {
+		return true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.files[path] == reason {
+		return false
+	}
+	w.files[path] = reason
+	return true
+}
+
+// done forgets the file once its transfer is started.
+func (w *WaitingFiles) done(path string) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.files, path)
+}
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"FileFlow/arrival"
+	"FileFlow/audit"
 	"FileFlow/dispatch"
 	"FileFlow/fileflows"
-	"FileFlow/files"
+	"FileFlow/logging"
+	"FileFlow/metrics"
+	"FileFlow/notify"
+	"FileFlow/throttle"
+	"FileFlow/tracing"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -16,8 +26,13 @@ import (
 // To work, a configuration file must be provided that describes all flows.
 // The configuration file format is described in the README.md.
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAudit(os.Args[2:]))
+	}
+
 	if len(os.Args) < 2 {
 		fmt.Println("Usage: FileFlow <config file>")
+		fmt.Println("       FileFlow audit [options] <config file>")
 		os.Exit(1)
 	}
 
@@ -25,81 +40,534 @@ func main() {
 
 	config, err := fileflows.LoadConfig(configFile)
 	if err != nil {
-		log.Fatal(err)
+		fatal("Cannot load configuration", err)
 	}
 
-	var wg sync.WaitGroup
-	processing := true
+	logger, err := logging.New(os.Stderr, config.Log)
+	if err != nil {
+		fatal("Log configuration error", err)
+	}
+	slog.SetDefault(logger)
+	slog.Debug("Used configuration", "delay", config.Delay)
+	for _, flow := range config.FileFlows {
+		slog.Debug("Used flow", "flow", flow)
+	}
+
+	shutdownTracing, err := tracing.Setup(config.Tracing)
+	if err != nil {
+		fatal("Tracing configuration error", err)
+	}
+	defer func() {
+		if err := shutdownTracing(context.Background()); err != nil {
+			slog.Warn("Cannot export the last traces", "error", err)
+		}
+	}()
+
+	globalLimiter, err := throttle.FromConfig(config.Bandwidth, config.BandwidthProfiles)
+	if err != nil {
+		fatal("Bandwidth configuration error", err)
+	}
+
+	pool := dispatch.NewSFTPPool(time.Duration(config.SFTPKeepAlive) * time.Second)
+	defer pool.Close()
+
+	var auditLog *audit.Log
+	if config.Audit.Path != "" {
+		if auditLog, err = audit.Open(config.Audit.Path, config.Audit.MaxSize, config.Audit.MaxFiles); err != nil {
+			fatal("Audit configuration error", err)
+		}
+		defer auditLog.Close()
+	}
 
+	var m *metrics.Metrics
+	if config.HTTPListen != "" || config.MetricsListen != "" {
+		m = metrics.New()
+	}
+
+	var notifiers notify.Notifiers
+	for _, webhook := range config.Webhooks {
+		w, err := notify.NewWebhook(webhook)
+		if err != nil {
+			fatal("Webhook configuration error", err)
+		}
+		notifiers = append(notifiers, w)
+	}
+	if config.Email.Server != "" {
+		email, err := notify.NewEmail(config.Email)
+		if err != nil {
+			fatal("Email configuration error", err)
+		}
+		notifiers = append(notifiers, email)
+	}
+	// The pending notifications have the grace period of the shutdown to be sent.
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownGrace)*time.Second)
+		defer cancel()
+		if err := notifiers.Close(ctx); err != nil {
+			slog.Warn("Pending notifications are dropped", "error", err)
+		}
+	}()
+
+	runners := make([]*flowRunner, len(config.FileFlows))
+	for i, flow := range config.FileFlows {
+		runners[i] = newFlowRunner(flow).
+			withLimiter(globalLimiter).
+			withPool(pool).
+			withAudit(auditLog).
+			withMetrics(m).
+			withNotifier(notifiers)
+	}
+	recoverFlows(runners)
+	d := newDaemon(runners, time.Duration(config.Delay)*time.Second, time.Duration(config.ShutdownGrace)*time.Second)
+
+	// The first signal shuts down the flows gracefully, the next one aborts the transfers in progress at once.
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		for sig := range c {
-			if sig == os.Interrupt {
-				log.Printf("FileFlow is shutting down...")
-				processing = false
+		for range c {
+			if d.shuttingDown() {
+				d.abort()
+			} else {
+				d.shutdown()
 			}
 		}
 	}()
 
-	for _, flow := range config.FileFlows {
-		wg.Add(1)
+	// With their own listener, the metrics can be exposed to the scrapers without exposing the control API.
+	apiMetrics := m
+	if config.MetricsListen != "" {
+		apiMetrics = nil
+		if err := serveHTTP(config.MetricsListen, m.Handler()); err != nil {
+			fatal("Cannot serve metrics", err)
+		}
+	}
+	if config.HTTPListen != "" {
+		if err := serveHTTP(config.HTTPListen, newHTTPHandler(apiMetrics, d)); err != nil {
+			fatal("Cannot serve HTTP API", err)
+		}
+	}
 
-		currentFlow := flow
-		go func() {
-			defer wg.Done()
-			for {
-				if !processing {
-					break
-				}
-				processFlow(currentFlow)
-				time.Sleep(time.Duration(int(time.Second) * config.Delay))
-			}
-			log.Printf("Flow %s finished", currentFlow.Name)
-		}()
+	d.run()
+	slog.Info("All flows finished")
+}
+
+// fatal logs the error and exits.
+func fatal(msg string, err error, args ...any) {
+	slog.Error(msg, append(args, "error", err)...)
+	os.Exit(1)
+}
+
+// flowRunner runs the cycles of a flow and keeps the flow state between them.
+type flowRunner struct {
+	flow         fileflows.FileFlow
+	strategy     dispatch.Strategy
+	availability dispatch.FolderAvailability
+	order        dispatch.Less
+	limiters     []*throttle.Limiter
+	pool         *dispatch.SFTPPool
+	journal      *dispatch.Journal
+	audit        *audit.Log
+	metrics      *metrics.Metrics
+	notifier     notify.Notifier
+	arrivals     *arrival.Monitor
+	waiting      *dispatch.WaitingFiles
+	recovered    bool
+	failing      bool
+	lastFile     time.Time
+	silent       bool
+	full         bool
+	trigger      chan struct{}
+	// stop is closed when the flow stops: no new file is dispatched.
+	stop <-chan struct{}
 
+	mu      sync.Mutex
+	paused  bool
+	running bool
+	last    *cycleResult
+}
+
+// newFlowRunner creates the runner of the flow. A new SFTP connection is opened for each cycle, see withPool to
+// change it. The shared services of the daemon are set with the with… methods.
+func newFlowRunner(flow fileflows.FileFlow) *flowRunner {
+	strategy, err := dispatch.NewStrategy(&flow)
+	if err != nil {
+		fatal("Flow configuration error", err, "flow", flow.Name)
 	}
 
-	wg.Wait()
-	log.Printf("All flows finished.")
+	availability, err := dispatch.NewFolderAvailability(&flow)
+	if err != nil {
+		fatal("Flow configuration error", err, "flow", flow.Name)
+	}
+
+	order, err := dispatch.NewOrder(&flow)
+	if err != nil {
+		fatal("Flow configuration error", err, "flow", flow.Name)
+	}
+
+	limiter, err := throttle.FromConfig(flow.Bandwidth, flow.BandwidthProfiles)
+	if err != nil {
+		fatal("Flow configuration error", err, "flow", flow.Name)
+	}
+
+	arrivals, err := arrival.FromConfig(flow)
+	if err != nil {
+		fatal("Flow configuration error", err, "flow", flow.Name)
+	}
+
+	var journal *dispatch.Journal
+	if flow.Journal != "" {
+		if journal, err = dispatch.OpenJournal(flow.Journal, logging.ForFlow(flow.Name)); err != nil {
+			fatal("Flow configuration error", err, "flow", flow.Name)
+		}
+	}
+
+	return &flowRunner{
+		flow:         flow,
+		strategy:     strategy,
+		availability: availability,
+		order:        order,
+		limiters:     []*throttle.Limiter{limiter},
+		journal:      journal,
+		arrivals:     arrivals,
+		waiting:      dispatch.NewWaitingFiles(),
+		lastFile:     time.Now(),
+		trigger:      make(chan struct{}, 1),
+	}
 }
 
-func processFlow(flow fileflows.FileFlow) {
-	var processor dispatch.FileProcessor
-	if flow.IsRemote() {
-		remote := dispatch.Connect(flow)
-		defer remote.Close()
-		processor = remote
-		log.Printf("Connected to server SFTP for flow %s", flow.Name)
+// withLimiter adds the limiter of the bandwidth shared by all the flows.
+func (r *flowRunner) withLimiter(limiter *throttle.Limiter) *flowRunner {
+	r.limiters = append(r.limiters, limiter)
+	return r
+}
+
+// withPool sets the pool the SFTP connections are taken from.
+func (r *flowRunner) withPool(pool *dispatch.SFTPPool) *flowRunner {
+	r.pool = pool
+	return r
+}
+
+// withAudit sets the audit journal recording the outcome of the transfers.
+func (r *flowRunner) withAudit(log *audit.Log) *flowRunner {
+	r.audit = log
+	return r
+}
+
+// withMetrics sets the metrics measuring the cycles and the transfers.
+func (r *flowRunner) withMetrics(m *metrics.Metrics) *flowRunner {
+	r.metrics = m
+	return r
+}
+
+// withNotifier sets the notifier of the events of the flow.
+func (r *flowRunner) withNotifier(notifier notify.Notifier) *flowRunner {
+	r.notifier = notifier
+	return r
+}
+
+// cycle runs a cycle of the flow, measures it and keeps its result. The transfers of the cycle are aborted when the
+// context is done.
+func (r *flowRunner) cycle(ctx context.Context) {
+	r.mu.Lock()
+	r.running = true
+	r.mu.Unlock()
+
+	ctx, span := tracing.Tracer().Start(ctx, "cycle",
+		trace.WithAttributes(tracing.FlowKey.String(r.flow.Name)))
+	start := time.Now()
+	result := r.processFlow(ctx)
+	result.Start = start
+	result.Duration = time.Since(start).Seconds()
+	r.metrics.Cycle(r.flow.Name, time.Since(start), result.Success)
+
+	span.SetAttributes(tracing.FilesKey.Int(result.Files), tracing.DispatchedKey.Int(result.Dispatched),
+		tracing.FailedKey.Int(result.Failed))
+	if result.Success {
+		tracing.End(span, nil)
 	} else {
-		processor = dispatch.Open(flow)
-		log.Printf("Start local reading for flow %s", flow.Name)
+		tracing.End(span, errors.New(result.Error))
+	}
+
+	r.mu.Lock()
+	r.running = false
+	r.last = &result
+	r.mu.Unlock()
+
+	// The failures are notified when the flow starts failing, not at each cycle.
+	switch {
+	case !result.Success:
+		r.failing = true
+	case r.failing:
+		r.failing = false
+		r.notify(notify.Event{Type: notify.FlowRecovered})
+	}
+	r.watchDestinations(result)
+	r.watchArrivals(result)
+	r.checkExpectations()
+
+	if r.metrics != nil {
+		for _, folder := range r.flow.DestinationFolders {
+			if fill, known := dispatch.FolderFill(r.availability, folder); known {
+				r.metrics.FolderFill(r.flow.Name, folder, fill)
+			}
+		}
+	}
+}
+
+// processFlow runs a cycle of the flow and returns its result. The steps of the cycle are traced as spans of the
+// context. No file is dispatched once the flow is stopping, and the transfers are aborted when the context is done.
+func (r *flowRunner) processFlow(ctx context.Context) cycleResult {
+	flow := r.flow
+	logger := logging.ForFlow(flow.Name)
+	processor, closeProcessor, err := r.connect(ctx)
+	if err != nil {
+		logger.Warn("Cannot connect to SFTP server", "error", err)
+		if !r.failing {
+			r.notify(notify.Event{Type: notify.ConnectionFailed, Error: err.Error()})
+		}
+		return cycleResult{Error: err.Error()}
+	}
+	defer closeProcessor()
+
+	if !r.recovered && !r.recover(processor) {
+		return cycleResult{Error: "recovery failed"}
 	}
+	r.complete(processor)
 
+	budget := dispatch.NewBudget(flow.MaxFilesPerCycle, flow.MaxBytesPerCycle)
+	dispatcher := dispatch.NewDispatcher(&flow, r.availability, processor).
+		WithStrategy(r.strategy).
+		WithJournal(r.journal).
+		WithAudit(r.audit).
+		WithMetrics(r.metrics).
+		WithNotifier(r.notifier).
+		WithBudget(budget).
+		WithWaiting(r.waiting)
+	if drained, err := dispatcher.DrainOverflow(ctx, r.stop); err != nil {
+		logger.Warn("Cannot drain overflow", "error", err)
+	} else if drained > 0 {
+		logger.Debug("Drained overflow files", "files", drained)
+	}
+
+	_, span := r.startSpan(ctx, "list_files")
 	allFiles := processor.ListFiles(flow)
+	span.SetAttributes(tracing.FilesKey.Int(len(allFiles)))
+	span.End()
+	r.arrivals.Seen(allFiles.Paths(), time.Now())
+	r.waiting.Keep(allFiles.Paths())
+	allFiles.SortBy(r.order)
+	dispatched, failed, waiting := dispatchFiles(ctx, r.stop, dispatcher, budget, allFiles, flow.Concurrency)
+	if left := len(allFiles) - dispatched - failed; left > 0 {
+		logger.Debug("Files are left for the next cycle", "files", left)
+	}
+	return cycleResult{Success: true, Files: len(allFiles), Dispatched: dispatched, Failed: failed, Waiting: waiting}
+}
 
-	aa := availabilityByFileCount{maxFileCount: flow.MaxFileCount}
-	dispatcher := dispatch.NewDispatcher(&flow, dispatch.FolderAvailability(aa), processor)
-	for _, f := range allFiles {
-		dst, err := dispatcher.Dispatch(f.Name())
+// connect returns the processor of the source folder of the flow and the function closing it. The connection is
+// traced as a span of the context.
+func (r *flowRunner) connect(ctx context.Context) (dispatch.FileProcessor, func(), error) {
+	logger := logging.ForFlow(r.flow.Name)
+	switch {
+	case r.flow.IsRemote() && r.pool != nil:
+		_, span := r.startSpan(ctx, "connect")
+		remote, err := r.pool.Get(r.flow)
+		tracing.End(span, err)
 		if err != nil {
-			log.Printf("WARN cannot move file %s : %v", f.Name(), err)
-		} else {
-			log.Printf("DEBUG Moved file %s to %s", f.Name(), dst)
+			return nil, nil, err
 		}
+		logger.Info("Connected to SFTP server")
+		return remote.Throttled(r.limiters...).Journaled(r.journal), func() {}, nil
+	case r.flow.IsRemote():
+		_, span := r.startSpan(ctx, "connect")
+		remote := dispatch.Connect(r.flow)
+		span.End()
+		logger.Info("Connected to SFTP server")
+		return remote.Throttled(r.limiters...).Journaled(r.journal), remote.Close, nil
 	}
 
+	logger.Info("Start local reading")
+	return dispatch.Open(r.flow).Throttled(r.limiters...).Journaled(r.journal), func() {}, nil
 }
 
-type availabilityByFileCount struct {
-	maxFileCount int
+// startSpan starts a span of the flow.
+func (r *flowRunner) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, name, trace.WithAttributes(tracing.FlowKey.String(r.flow.Name)))
+}
+
+// recoverFlows recovers all the flows before any of them starts, as the flows may share their destination and
+// overflow folders: the temporary files of a flow must not be cleaned while another flow is writing them.
+// A flow whose recovery fails retries at its first cycle.
+func recoverFlows(runners []*flowRunner) {
+	for _, r := range runners {
+		processor, closeProcessor, err := r.connect(context.Background())
+		if err != nil {
+			logging.ForFlow(r.flow.Name).Warn("Cannot connect to SFTP server to recover the flow", "error", err)
+			continue
+		}
+		r.recover(processor)
+		closeProcessor()
+	}
 }
 
-func (a availabilityByFileCount) IsAvailable(folder string) bool {
-	if a.maxFileCount == 0 {
-		return true
+// recover completes or rolls back the deliveries of the flow interrupted by a crash, then cleans the temporary files
+// left by the transfers. It's done once, before the first cycle of the flow, when the source files are known.
+// It tells if the cycle can go on: no file is transferred before the recovery succeeds.
+func (r *flowRunner) recover(processor dispatch.FileProcessor) bool {
+	logger := logging.ForFlow(r.flow.Name)
+	remover, _ := processor.(dispatch.SourceRemover)
+	completed, rolledBack, err := r.journal.Recover(remover)
+	if err != nil {
+		logger.Warn("Cannot recover deliveries", "error", err)
+		return false
+	}
+	if completed > 0 || rolledBack > 0 {
+		logger.Debug("Recovered deliveries", "completed", completed, "rolled_back", rolledBack)
 	}
 
-	count := files.CountFiles(folder)
-	return count > -1 && count < a.maxFileCount
+	removed, kept, err := dispatch.RecoverTempFiles(&r.flow, processor.ListFiles(r.flow))
+	if err != nil {
+		logger.Warn("Cannot recover temporary files", "error", err)
+		return false
+	}
+	if removed > 0 || kept > 0 {
+		logger.Debug("Recovered temporary files", "removed", removed, "kept", kept)
+	}
+
+	r.recovered = true
+	return true
+}
+
+// complete completes the deliveries of the flow whose source file couldn't be removed. The files still not removed
+// are kept in the journal and are not dispatched again.
+func (r *flowRunner) complete(processor dispatch.FileProcessor) {
+	logger := logging.ForFlow(r.flow.Name)
+	remover, _ := processor.(dispatch.SourceRemover)
+	completed, err := r.journal.Complete(remover)
+	if err != nil {
+		logger.Warn("Cannot complete deliveries", "error", err)
+	}
+	if completed > 0 {
+		logger.Debug("Completed deliveries", "completed", completed)
+	}
+}
+
+// watchDestinations notifies that the destination folders of the flow are full when files start waiting for them.
+// It's notified once until a cycle leaves no file waiting.
+func (r *flowRunner) watchDestinations(result cycleResult) {
+	switch {
+	case result.Waiting > 0 && !r.full:
+		r.full = true
+		r.notify(notify.Event{Type: notify.DestinationFull, Files: result.Waiting})
+	case result.Success && result.Waiting == 0:
+		r.full = false
+	}
+}
+
+// watchArrivals notifies that the flow received no file when its last file is older than its no-file alert delay.
+// It's notified once until the next file arrives.
+func (r *flowRunner) watchArrivals(result cycleResult) {
+	now := time.Now()
+	switch {
+	case result.Dispatched > 0:
+		r.lastFile, r.silent = now, false
+	case r.flow.NoFileAlert > 0 && !r.silent && now.Sub(r.lastFile) >= time.Duration(r.flow.NoFileAlert)*time.Second:
+		r.silent = true
+		since := r.lastFile
+		r.notify(notify.Event{Type: notify.NoFileReceived, Since: &since})
+	}
+}
+
+// checkExpectations measures the new statuses of the expected deliveries of the flow, and notifies the missed and
+// late ones. It's checked even when the cycle fails, so that the deliveries missed during an outage are notified.
+func (r *flowRunner) checkExpectations() {
+	for _, outcome := range r.arrivals.Check(time.Now()) {
+		r.metrics.Expectation(r.flow.Name, outcome.Expectation, outcome.Status)
+
+		deadline := outcome.Deadline
+		event := notify.Event{Expectation: outcome.Expectation, Deadline: &deadline, Files: outcome.Files}
+		switch outcome.Status {
+		case arrival.Missed:
+			event.Type = notify.ExpectationMissed
+		case arrival.Late:
+			event.Type = notify.ExpectationLate
+		default:
+			logging.ForFlow(r.flow.Name).Info("Expected delivery on time", "expectation", outcome.Expectation)
+			continue
+		}
+		logging.ForFlow(r.flow.Name).Warn("Expected delivery "+outcome.Status, "expectation", outcome.Expectation,
+			"deadline", outcome.Deadline, "files", outcome.Files)
+		r.notify(event)
+	}
+}
+
+// notify notifies the event of the flow, if the runner has a notifier.
+func (r *flowRunner) notify(e notify.Event) {
+	if r.notifier == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Flow = r.flow.Name
+	r.notifier.Notify(e)
+}
+
+// dispatchFiles dispatches the files with a pool of workers. With one worker (or less), the files are dispatched one
+// after the other, in the order of the list. Otherwise, the files are started in the order of the list.
+// No more file is started once stop is closed, the context is done or the budget of the cycle is spent: the files
+// not started stay in the source folder for the next cycle.
+// It returns the number of dispatched and failed files and, among the failed files, the number of files waiting for an
+// available destination folder.
+func dispatchFiles(ctx context.Context, stop <-chan struct{}, dispatcher *dispatch.Dispatcher, budget *dispatch.Budget,
+	allFiles dispatch.FileList, workers int) (dispatched int, failed int, waiting int) {
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan dispatch.SourceFile)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				dst, err := dispatcher.DispatchFile(ctx, f)
+				budget.Settle(f.Size(), err == nil)
+				var dispatcherError dispatch.DispatcherError
+				mu.Lock()
+				switch {
+				case errors.As(err, &dispatcherError):
+					failed++
+					waiting++
+					dispatcher.Logger().Debug("File waits for an available folder", "file", f.Path)
+				case err != nil:
+					failed++
+					dispatcher.Logger().Warn("Cannot move file", "file", f.Path, "error", err)
+				default:
+					dispatched++
+					dispatcher.Logger().Debug("Moved file", "file", f.Path, "dst", dst)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, f := range allFiles {
+		if !budget.Reserve(f.Size()) {
+			break
+		}
+		select {
+		case queue <- f:
+		case <-stop:
+			budget.Settle(f.Size(), false)
+			break feed
+		case <-ctx.Done():
+			budget.Settle(f.Size(), false)
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	return dispatched, failed, waiting
 }
@@ -3,11 +3,14 @@ package main
 import (
 	"FileFlow/fileflows"
 	"FileFlow/files"
+	"FileFlow/notify"
 	"compress/gzip"
+	"context"
 	"io"
 	"log"
 	"os"
 	"testing"
+	"time"
 )
 
 var (
@@ -44,7 +47,7 @@ func TestMoveFileFromSftp(t *testing.T) {
 		"")
 
 	// When
-	processFlow(flow)
+	newFlowRunner(flow).processFlow(context.Background())
 
 	// Then
 	if _, err := os.Stat(expectedResultFile); err != nil {
@@ -83,7 +86,7 @@ func TestCompressFileFromSftp(t *testing.T) {
 		"")
 
 	// When
-	processFlow(flow)
+	newFlowRunner(flow).processFlow(context.Background())
 
 	// Then
 	if _, err := os.Stat(expectedResultFile); err != nil {
@@ -119,7 +122,7 @@ func TestCompressFileFromLocal(t *testing.T) {
 		"")
 
 	// When
-	processFlow(flow)
+	newFlowRunner(flow).processFlow(context.Background())
 
 	// Then
 	if _, err := os.Stat(expectedResultFile); err != nil {
@@ -139,7 +142,7 @@ func TestCancelCompressFileFromSftp(t *testing.T) {
 
 	sourceFile := createGzipFile(localSftpFolder, "file.txt")
 	unexpectedResultFile := localDestFolder + "file.txt.gz.gz"
-	unexpectedTmpFile := localDestFolder + "file.txt.gz.tmp"
+	unexpectedTmpFile := localDestFolder + "file.txt.gz" + files.TempSuffix
 	defer func() {
 		_ = os.Remove(sourceFile)
 		_ = os.Remove(unexpectedResultFile)
@@ -160,7 +163,7 @@ func TestCancelCompressFileFromSftp(t *testing.T) {
 		"")
 
 	// When
-	processFlow(flow)
+	newFlowRunner(flow).processFlow(context.Background())
 
 	// Then
 	if _, err := os.Stat(unexpectedResultFile); err == nil {
@@ -201,7 +204,7 @@ func TestUncompressFileFromSftp(t *testing.T) {
 		"")
 
 	// When
-	processFlow(flow)
+	newFlowRunner(flow).processFlow(context.Background())
 
 	// Then
 	if _, err := os.Stat(expectedResultFile); err != nil {
@@ -237,7 +240,7 @@ func TestUncompressFileFromLocal(t *testing.T) {
 		"")
 
 	// When
-	processFlow(flow)
+	newFlowRunner(flow).processFlow(context.Background())
 
 	// Then
 	if _, err := os.Stat(expectedResultFile); err != nil {
@@ -257,7 +260,7 @@ func TestCancelUncompressFileFromSftp(t *testing.T) {
 
 	sourceFile := createTextFile(localSftpFolder, "file.txt")
 	unexpectedResultFile := localDestFolder + "file.txt"
-	unexpectedTmpFile := localDestFolder + "file.txt.tmp"
+	unexpectedTmpFile := localDestFolder + "file.txt" + files.TempSuffix
 	defer func() {
 		_ = os.Remove(sourceFile)
 		_ = os.Remove(unexpectedResultFile)
@@ -278,7 +281,7 @@ func TestCancelUncompressFileFromSftp(t *testing.T) {
 		"")
 
 	// When
-	processFlow(flow)
+	newFlowRunner(flow).processFlow(context.Background())
 
 	// Then
 	if _, err := os.Stat(unexpectedResultFile); err == nil {
@@ -323,7 +326,7 @@ func TestMoveToOverflowDir(t *testing.T) {
 		localOverflowFolder)
 
 	// When
-	processFlow(flow)
+	newFlowRunner(flow).processFlow(context.Background())
 
 	// Then
 	if _, err := os.Stat(unexpectedResultFile); err == nil {
@@ -368,7 +371,7 @@ func TestMoveToOverflowDirWhileItIsNotEmpty(t *testing.T) {
 		localOverflowFolder)
 
 	// When
-	processFlow(flow)
+	newFlowRunner(flow).processFlow(context.Background())
 
 	// Then
 	if _, err := os.Stat(unexpectedResultFile); err == nil {
@@ -408,7 +411,7 @@ func TestMoveFromLocalDir(t *testing.T) {
 		"")
 
 	// When
-	processFlow(flow)
+	newFlowRunner(flow).processFlow(context.Background())
 
 	// Then
 	if _, err := os.Stat(unexpectedLocalFile); err == nil {
@@ -479,3 +482,74 @@ func assertFoldersAreEmpty() {
 		log.Fatal("Local dest folder is not empty")
 	}
 }
+
+func TestNoFileAlert(t *testing.T) {
+	// Given
+	recorder := &eventRecorder{}
+	runner := &flowRunner{flow: fileflows.FileFlow{Name: "ACME", NoFileAlert: 3600}, notifier: recorder}
+	runner.lastFile = time.Now().Add(-2 * time.Hour)
+
+	// When
+	runner.watchArrivals(cycleResult{Success: true})
+	runner.watchArrivals(cycleResult{Success: true})
+	runner.watchArrivals(cycleResult{Success: true, Files: 1, Dispatched: 1})
+	runner.watchArrivals(cycleResult{Success: true})
+
+	// Then
+	if len(recorder.events) != 1 {
+		t.Fatalf("Expected 1 event, got %+v", recorder.events)
+	}
+	if e := recorder.events[0]; e.Type != notify.NoFileReceived || e.Flow != "ACME" || e.Since == nil {
+		t.Errorf("Expected no file event of flow ACME, got %+v", e)
+	}
+}
+
+func TestDestinationFullAlert(t *testing.T) {
+	// Given
+	recorder := &eventRecorder{}
+	runner := &flowRunner{flow: fileflows.FileFlow{Name: "ACME"}, notifier: recorder}
+
+	// When
+	runner.watchDestinations(cycleResult{Success: true, Files: 2, Failed: 2, Waiting: 2})
+	runner.watchDestinations(cycleResult{Success: true, Files: 3, Failed: 3, Waiting: 3})
+	runner.watchDestinations(cycleResult{Success: true, Files: 3, Dispatched: 3})
+	runner.watchDestinations(cycleResult{Success: true, Files: 1, Failed: 1, Waiting: 1})
+
+	// Then
+	if len(recorder.events) != 2 {
+		t.Fatalf("Expected 2 events, got %+v", recorder.events)
+	}
+	if e := recorder.events[0]; e.Type != notify.DestinationFull || e.Flow != "ACME" || e.Files != 2 {
+		t.Errorf("Expected destination full event of flow ACME with 2 files, got %+v", e)
+	}
+}
+
+type eventRecorder struct {
+	events []notify.Event
+}
+
+func (r *eventRecorder) Notify(e notify.Event) {
+	r.events = append(r.events, e)
+}
+
+func TestNoFileDispatchedWhenStopping(t *testing.T) {
+	// Given
+	source, dest := t.TempDir(), t.TempDir()
+	sourceFile := createTextFile(source+"/", "file.txt")
+	flow := fileflows.NewLocalFileFlow("Move ACME files", source, ".+", []string{dest}, fileflows.Move, 0, "")
+	runner := newFlowRunner(flow)
+	stop := make(chan struct{})
+	close(stop)
+	runner.stop = stop
+
+	// When
+	result := runner.processFlow(context.Background())
+
+	// Then
+	if result.Files != 1 || result.Dispatched != 0 {
+		t.Errorf("Expected 1 file and no dispatched file, got %+v", result)
+	}
+	if _, err := os.Stat(sourceFile); err != nil {
+		t.Errorf("File should be found: %s", sourceFile)
+	}
+}
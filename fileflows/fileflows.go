@@ -2,10 +2,15 @@
 package fileflows
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v3"
-	"log"
+	"log/slog"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type FlowOperation int
@@ -16,10 +21,97 @@ const (
 	Decompression
 )
 
+func (o FlowOperation) String() string {
+	switch o {
+	case Move:
+		return "move"
+	case Compression:
+		return "compression"
+	case Decompression:
+		return "decompression"
+	}
+	return fmt.Sprintf("operation %d", int(o))
+}
+
 // FFConfig is the presentation of all flows defined in the config YAML file.
 type FFConfig struct {
-	Delay     int
-	FileFlows []FileFlow `yaml:"file_flows"`
+	Delay             int
+	SFTPKeepAlive     int                `yaml:"sftp_keepalive"`
+	ShutdownGrace     int                `yaml:"shutdown_grace"`
+	FileFlows         []FileFlow         `yaml:"file_flows"`
+	Bandwidth         int64              `yaml:"bandwidth"`
+	BandwidthProfiles []BandwidthProfile `yaml:"bandwidth_profiles"`
+	Audit             AuditConfig
+	HTTPListen        string `yaml:"http_listen"`
+	MetricsListen     string `yaml:"metrics_listen"`
+	Log               LogConfig
+	Webhooks          []WebhookConfig
+	Email             EmailConfig
+	Tracing           TracingConfig
+}
+
+// TracingConfig sets the export of the traces of the flows to an OpenTelemetry collector, with OTLP over HTTP.
+// Without endpoint, nothing is traced. SampleRatio is the part of the cycles traced, all of them by default.
+type TracingConfig struct {
+	Endpoint    string
+	Headers     map[string]string
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// WebhookConfig sets a webhook receiving the events of the flows as JSON POST requests.
+// Events and Flows select the notified events and flows, all of them when empty. Template is a text/template of the
+// JSON payload, the event itself being the default payload. A failed request is retried Retries times (3 when zero,
+// never when negative), RetryDelay seconds apart, the delay doubling at each retry.
+type WebhookConfig struct {
+	URL        string
+	Events     []string
+	Flows      []string
+	Template   string
+	Headers    map[string]string
+	Retries    int
+	RetryDelay int `yaml:"retry_delay"`
+	Timeout    int
+}
+
+// LogConfig sets the logs: the level (debug, info, warn or error), the format (text or json) and the attributes whose
+// value is redacted, in addition to the sensitive ones (private key paths, passwords, secrets and tokens).
+type LogConfig struct {
+	Level  string
+	Format string
+	Redact []string
+}
+
+// EmailConfig sets the email alerts of the events of the flows. Without server, no email is sent.
+// Events and Flows select the alerted events and flows: the failures of all the flows by default. The alerts are sent
+// immediately, or gathered into a digest sent every Digest seconds.
+type EmailConfig struct {
+	Server   string
+	Port     int
+	StartTLS bool `yaml:"starttls"`
+	Username string
+	Password string
+	From     string
+	To       []string
+	Events   []string
+	Flows    []string
+	Digest   int
+}
+
+// AuditConfig sets the audit journal recording the outcome of the transfers. Without path, nothing is recorded.
+// The journal is rotated when it reaches max_size bytes, and max_files files are kept.
+type AuditConfig struct {
+	Path     string
+	MaxSize  int64 `yaml:"max_size"`
+	MaxFiles int   `yaml:"max_files"`
+}
+
+// BandwidthProfile is a bandwidth limit in bytes per second applied from a time of the day (HH:MM) to another one.
+// A zero limit means no limit during the window.
+type BandwidthProfile struct {
+	From  string
+	To    string
+	Limit int64
 }
 
 // FileFlow represents a flow defined in the config YAML file.
@@ -27,14 +119,103 @@ type FileFlow struct {
 	Name               string
 	Server             string
 	Port               int
+	User               string
 	PrivateKeyPath     string `yaml:"private_key_path"`
 	SourceFolder       string `yaml:"from"`
 	Pattern            string
 	DestinationFolders []string `yaml:"to"`
 	Regexp             *regexp.Regexp
 	Operation          FlowOperation
-	MaxFileCount       int    `yaml:"max_file_count"`
-	OverflowFolder     string `yaml:"overflow_folder"`
+	MaxFileCount       int      `yaml:"max_file_count"`
+	OverflowFolder     string   `yaml:"overflow_folder"`
+	OverflowFolders    []string `yaml:"overflow_folders"`
+	QuarantineFolder   string   `yaml:"quarantine_folder"`
+	PreserveTree       bool     `yaml:"preserve_tree"`
+	MaxDepth           int      `yaml:"max_depth"`
+	MaxFolderBytes     int64    `yaml:"max_folder_bytes"`
+	MaxFileSize        int64    `yaml:"max_file_size"`
+	MinFileSize        int64    `yaml:"min_file_size"`
+	FreeSpaceReserve   int64    `yaml:"free_space_reserve"`
+	DecompressionRatio float64  `yaml:"decompression_ratio"`
+	Strategy           string
+	Weights            []int
+	HashGroup          string            `yaml:"hash_group"`
+	Availability       *AvailabilityRule `yaml:"availability"`
+	Order              string
+	OrderGroup         string             `yaml:"order_group"`
+	MaxFilesPerCycle   int                `yaml:"max_files_per_cycle"`
+	MaxBytesPerCycle   int64              `yaml:"max_bytes_per_cycle"`
+	Bandwidth          int64              `yaml:"bandwidth"`
+	BandwidthProfiles  []BandwidthProfile `yaml:"bandwidth_profiles"`
+	Concurrency        int
+	Resume             bool  `yaml:"resume"`
+	ResumeVerifyBytes  int64 `yaml:"resume_verify_bytes"`
+	ChunkSize          int64 `yaml:"chunk_size"`
+	ChunkWorkers       int   `yaml:"chunk_workers"`
+	Durable            bool
+	Journal            string
+	NoFileAlert        int           `yaml:"no_file_alert"`
+	Expectations       []Expectation `yaml:"expectations"`
+}
+
+// Expectation is a delivery expected from a partner every day: at least MinFiles files (1 by default) matching
+// Pattern (all the files of the flow when empty) by the Deadline time of the day (HH:MM), on the Days of the week
+// (mon to fri by default).
+type Expectation struct {
+	Name     string
+	Pattern  string
+	MinFiles int `yaml:"min_files"`
+	Deadline string
+	Days     []string
+}
+
+// LogValue describes the flow in the logs. The private key path is redacted by the FileFlow loggers.
+func (f FileFlow) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("name", f.Name),
+		slog.String("server", f.Server),
+		slog.Int("port", f.Port),
+		slog.String("user", f.User),
+		slog.String("private_key_path", f.PrivateKeyPath),
+		slog.String("from", f.SourceFolder),
+		slog.String("pattern", f.Pattern),
+		slog.Any("to", f.DestinationFolders),
+		slog.String("operation", f.Operation.String()),
+	)
+}
+
+// AvailabilityRule describes a rule of availability for the destination folders of a flow.
+// Type is the name of the rule. The "all" and "any" rules combine their Rules with AND and OR.
+// Params holds all the other keys of the rule.
+//
+// Example:
+//
+//	availability:
+//	  type: any
+//	  rules:
+//	    - type: file_count
+//	      max: 10
+//	    - type: time_window
+//	      from: "20:00"
+//	      to: "06:00"
+type AvailabilityRule struct {
+	Type   string
+	Rules  []AvailabilityRule
+	Params map[string]string `yaml:",inline"`
+}
+
+// Int returns the integer value of the parameter. A missing parameter is 0.
+func (r AvailabilityRule) Int(name string) (int64, error) {
+	value, ok := r.Params[name]
+	if !ok {
+		return 0, nil
+	}
+
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("parameter %s of rule %s is not an integer: %s", name, r.Type, value)
+	}
+	return i, nil
 }
 
 func LoadConfig(path string) (*FFConfig, error) {
@@ -54,9 +235,8 @@ func ReadConfiguration(cfg string) (*FFConfig, error) {
 		return nil, err
 	}
 
-	log.Printf("DEBUG - Read configuration: %+v", read)
-
 	flows := make([]FileFlow, len(read.FileFlows))
+	journals := make(map[string]string)
 	for i, flow := range read.FileFlows {
 		pattern := usedPattern(&flow)
 
@@ -82,6 +262,17 @@ func ReadConfiguration(cfg string) (*FFConfig, error) {
 				flow.MaxFileCount,
 				flow.OverflowFolder)
 		}
+		flows[i].withOptions(&flow)
+		if err := flows[i].validate(); err != nil {
+			return nil, err
+		}
+		// Two flows appending to the same journal would replay (and truncate) the deliveries of each other.
+		if journal := flows[i].Journal; journal != "" {
+			if other, found := journals[filepath.Clean(journal)]; found {
+				return nil, fmt.Errorf("flow %s: journal %s is already used by flow %s", flows[i].Name, journal, other)
+			}
+			journals[filepath.Clean(journal)] = flows[i].Name
+		}
 	}
 
 	var delay int
@@ -91,16 +282,58 @@ func ReadConfiguration(cfg string) (*FFConfig, error) {
 		delay = read.Delay
 	}
 
-	result := FFConfig{
-		delay,
-		flows,
+	// A negative keepalive disables the keepalive requests.
+	keepAlive := read.SFTPKeepAlive
+	if keepAlive == 0 {
+		keepAlive = 30
+	} else if keepAlive < 0 {
+		keepAlive = 0
+	}
+
+	grace := read.ShutdownGrace
+	if grace == 0 {
+		grace = 30
 	}
 
-	log.Printf("DEBUG - Used configuration: %+v", result)
+	result := FFConfig{
+		Delay:             delay,
+		SFTPKeepAlive:     keepAlive,
+		ShutdownGrace:     grace,
+		FileFlows:         flows,
+		Bandwidth:         read.Bandwidth,
+		BandwidthProfiles: read.BandwidthProfiles,
+		Audit:             read.Audit,
+		HTTPListen:        read.HTTPListen,
+		MetricsListen:     read.MetricsListen,
+		Log:               read.Log,
+		Webhooks:          read.Webhooks,
+		Email:             read.Email,
+		Tracing:           read.Tracing,
+	}
 
 	return &result, nil
 }
 
+// ParseTimeOfDay parses a HH:MM time and returns the duration since midnight.
+func ParseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a HH:MM time", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// InTimeWindow tells if the time t is in the window of the day from..to, durations since midnight (local time). When to
+// is before from, the window goes over midnight.
+func InTimeWindow(from time.Duration, to time.Duration, t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	sinceMidnight := t.Sub(midnight)
+	if from <= to {
+		return sinceMidnight >= from && sinceMidnight < to
+	}
+	return sinceMidnight >= from || sinceMidnight < to
+}
+
 func isSFTPFlow(f *FileFlow) bool {
 	return f.Server != "" && f.PrivateKeyPath != ""
 }
@@ -134,6 +367,99 @@ func (f *FileFlow) destination(path string) string {
 	return ""
 }
 
+// withOptions copies the optional settings of the read flow that are not set by the constructors.
+func (f *FileFlow) withOptions(read *FileFlow) {
+	f.PreserveTree = read.PreserveTree
+	f.MaxDepth = read.MaxDepth
+	f.MaxFolderBytes = read.MaxFolderBytes
+	f.MaxFileSize = read.MaxFileSize
+	f.MinFileSize = read.MinFileSize
+	f.FreeSpaceReserve = read.FreeSpaceReserve
+	f.DecompressionRatio = read.DecompressionRatio
+	f.Strategy = read.Strategy
+	f.Weights = read.Weights
+	f.HashGroup = read.HashGroup
+	f.Availability = read.Availability
+	f.OverflowFolders = read.OverflowFolders
+	f.QuarantineFolder = read.QuarantineFolder
+	f.Order = read.Order
+	f.OrderGroup = read.OrderGroup
+	f.MaxFilesPerCycle = read.MaxFilesPerCycle
+	f.MaxBytesPerCycle = read.MaxBytesPerCycle
+	f.Bandwidth = read.Bandwidth
+	f.BandwidthProfiles = read.BandwidthProfiles
+	f.Concurrency = read.Concurrency
+	f.Resume = read.Resume
+	f.ResumeVerifyBytes = read.ResumeVerifyBytes
+	f.ChunkSize = read.ChunkSize
+	f.ChunkWorkers = read.ChunkWorkers
+	f.Durable = read.Durable
+	f.Journal = read.Journal
+	f.NoFileAlert = read.NoFileAlert
+	f.Expectations = read.Expectations
+	f.User = read.User
+}
+
+// validate checks the consistency of the flow settings.
+func (f *FileFlow) validate() error {
+	if len(f.OverflowFolders) > 0 {
+		if f.OverflowFolder != "" {
+			return fmt.Errorf("flow %s: overflow_folder and overflow_folders cannot be both specified", f.Name)
+		}
+		if len(f.OverflowFolders) != len(f.DestinationFolders) {
+			return fmt.Errorf("flow %s: overflow_folders needs one folder per destination folder, got %d for %d",
+				f.Name, len(f.OverflowFolders), len(f.DestinationFolders))
+		}
+	}
+	if f.QuarantineFolder != "" {
+		quarantine := filepath.Clean(f.QuarantineFolder) + "/"
+		for _, overflowFolder := range f.AllOverflowFolders() {
+			if strings.HasPrefix(quarantine, filepath.Clean(overflowFolder)+"/") {
+				return fmt.Errorf("flow %s: quarantine_folder cannot be inside the overflow folder %s", f.Name,
+					overflowFolder)
+			}
+		}
+	}
+	if f.Journal != "" && !f.Durable {
+		return fmt.Errorf("flow %s: journal needs durable delivery", f.Name)
+	}
+	return nil
+}
+
+// AllOverflowFolders returns all the overflow folders of the flow.
+func (f *FileFlow) AllOverflowFolders() []string {
+	if len(f.OverflowFolders) > 0 {
+		return f.OverflowFolders
+	}
+	if f.OverflowFolder != "" {
+		return []string{f.OverflowFolder}
+	}
+	return nil
+}
+
+// QuarantineFolderOf returns the folder where the files of the overflow folder that can never be drained are moved:
+// the quarantine folder of the flow or, without it, the overflow folder with the .quarantine suffix.
+func (f *FileFlow) QuarantineFolderOf(overflowFolder string) string {
+	if f.QuarantineFolder != "" {
+		return f.QuarantineFolder
+	}
+	return strings.TrimSuffix(overflowFolder, "/") + ".quarantine"
+}
+
+// OverflowFolderOf returns the overflow folder of the destination folder. It's empty when there is none.
+func (f *FileFlow) OverflowFolderOf(destination string) string {
+	if len(f.OverflowFolders) == 0 {
+		return f.OverflowFolder
+	}
+
+	for i, folder := range f.DestinationFolders {
+		if folder == destination {
+			return f.OverflowFolders[i]
+		}
+	}
+	return ""
+}
+
 func (f *FileFlow) IsRemote() bool {
 	return f.Port > 0
 }
@@ -148,9 +474,14 @@ func (f *FileFlow) IsRemote() bool {
 // maxFileCount is the maximum number of files that can be downloaded to a destination folder.
 // overflowFolder is the path to the folder where overflow files are stored.
 //
-// For overflow, it's valid when one destination folder and maxFileCount are specified.
-// By default, when the number of files reaches the maxFileCount, file downloads are stopped.
-// But, if overflowFolder is specified, file are downloaded into the overflow folder.
+// Files are searched recursively in the source folder. By default, they are all put at the root of the destination
+// folder (the tree is flattened). Set PreserveTree to keep the relative folder tree in the destination and MaxDepth
+// to limit the recursion (1 means only the files of the source folder itself, 0 means no limit).
+//
+// By default, when all the destination folders are full, file downloads are stopped.
+// But, if overflowFolder is specified, file are downloaded into the overflow folder. Each destination folder may also
+// have its own overflow folder (see OverflowFolders). While an overflow folder holds files, its destination folders
+// don't receive new files.
 func NewSFTPFileFlow(name string,
 	server string, port int,
 	privateKeyPath string,
@@ -161,21 +492,22 @@ func NewSFTPFileFlow(name string,
 	overflowFolder string) FileFlow {
 
 	if server == "" || port == 0 || privateKeyPath == "" {
-		log.Fatal("SFTP flow configuration error: server, port or private_key_path is empty")
+		slog.Error("SFTP flow configuration error: server, port or private_key_path is empty", "flow", name)
+		os.Exit(1)
 	}
 
 	return FileFlow{
-		name,
-		server,
-		port,
-		privateKeyPath,
-		sourceFolder,
-		pattern,
-		destinations,
-		regexp.MustCompile(pattern),
-		operation,
-		maxFileCount,
-		overflowFolder,
+		Name:               name,
+		Server:             server,
+		Port:               port,
+		PrivateKeyPath:     privateKeyPath,
+		SourceFolder:       sourceFolder,
+		Pattern:            pattern,
+		DestinationFolders: destinations,
+		Regexp:             regexp.MustCompile(pattern),
+		Operation:          operation,
+		MaxFileCount:       maxFileCount,
+		OverflowFolder:     overflowFolder,
 	}
 }
 
@@ -187,10 +519,6 @@ func NewLocalFileFlow(name, sourceFolder, pattern string,
 	maxFileCount int,
 	overflowFolder string) FileFlow {
 
-	if len(destinations) > 1 && overflowFolder != "" {
-		log.Fatal("Overflow folder cannot be specified with multiple destinations")
-	}
-
 	return FileFlow{
 		Name:               name,
 		SourceFolder:       sourceFolder,
@@ -3,6 +3,7 @@ package fileflows
 import (
 	"regexp"
 	"testing"
+	"time"
 )
 
 func TestSFTPConfigurationRead(t *testing.T) {
@@ -145,12 +146,223 @@ file_flows:
 	}
 }
 
+func TestAvailabilityConfigurationRead(t *testing.T) {
+	// Given
+	yaml := `
+file_flows:
+  - name: Move ACME files
+    from: /home/user/fileflow/acme
+    to:
+    - /Users/Batman/fileflow/acme
+    availability:
+      type: any
+      rules:
+        - type: file_count
+          max: 3
+        - type: time_window
+          from: "20:00"
+          to: "06:00"
+`
+
+	// When
+	cfg, err := ReadConfiguration(yaml)
+	if err != nil {
+		t.Fatalf("Error reading configuration: %s", err)
+	}
+
+	// Then
+	rule := cfg.FileFlows[0].Availability
+	if rule == nil || rule.Type != "any" || len(rule.Rules) != 2 {
+		t.Fatalf("Expected an any rule with 2 sub rules, got %+v", rule)
+	}
+
+	if max, err := rule.Rules[0].Int("max"); err != nil || max != 3 {
+		t.Errorf("Expected max 3, got %d (%v)", max, err)
+	}
+
+	if rule.Rules[1].Params["from"] != "20:00" {
+		t.Errorf("Expected from 20:00, got %s", rule.Rules[1].Params["from"])
+	}
+}
+
+func TestOverflowFoldersConfigurationRead(t *testing.T) {
+	var tests = []struct {
+		overflow string
+		valid    bool
+	}{
+		{"overflow_folders: [/overflow1, /overflow2]", true},
+		{"overflow_folders: [/overflow1]", false},
+		{"overflow_folder: /overflow", true},
+		{"overflow_folder: /overflow\n    overflow_folders: [/overflow1, /overflow2]", false},
+	}
+
+	for _, test := range tests {
+		// Given
+		yaml := `
+file_flows:
+  - name: Move ACME files
+    from: /home/user/fileflow/acme
+    to: [/dest1, /dest2]
+    ` + test.overflow + `
+`
+
+		// When
+		cfg, err := ReadConfiguration(yaml)
+
+		// Then
+		if test.valid && err != nil {
+			t.Errorf("Error reading configuration with %s: %s", test.overflow, err)
+		}
+
+		if !test.valid && err == nil {
+			t.Errorf("Expected error with %s, got nothing", test.overflow)
+		}
+
+		if test.valid && cfg.FileFlows[0].OverflowFolderOf("/dest2") == "" {
+			t.Errorf("Expected an overflow folder for /dest2 with %s", test.overflow)
+		}
+	}
+}
+
+func TestBandwidthConfigurationRead(t *testing.T) {
+	// Given
+	yaml := `
+bandwidth: 1048576
+file_flows:
+  - name: Move ACME files
+    from: /home/user/fileflow/acme
+    to:
+    - /Users/Batman/fileflow/acme
+    bandwidth: 524288
+    bandwidth_profiles:
+      - from: "08:00"
+        to: "18:00"
+        limit: 131072
+`
+
+	// When
+	cfg, err := ReadConfiguration(yaml)
+	if err != nil {
+		t.Fatalf("Error reading configuration: %s", err)
+	}
+
+	// Then
+	if cfg.Bandwidth != 1048576 {
+		t.Errorf("Expected global bandwidth 1048576, got %d", cfg.Bandwidth)
+	}
+
+	flow := cfg.FileFlows[0]
+	if flow.Bandwidth != 524288 {
+		t.Errorf("Expected flow bandwidth 524288, got %d", flow.Bandwidth)
+	}
+
+	if len(flow.BandwidthProfiles) != 1 || flow.BandwidthProfiles[0] != (BandwidthProfile{"08:00", "18:00", 131072}) {
+		t.Errorf("Expected one bandwidth profile, got %+v", flow.BandwidthProfiles)
+	}
+}
+
+func TestDurableConfigurationRead(t *testing.T) {
+	var tests = []struct {
+		durability string
+		valid      bool
+	}{
+		{"durable: true", true},
+		{"durable: true\n    journal: /var/lib/fileflow/acme.journal", true},
+		{"journal: /var/lib/fileflow/acme.journal", false},
+	}
+
+	for _, test := range tests {
+		// Given
+		yaml := `
+file_flows:
+  - name: Move ACME files
+    from: /home/user/fileflow/acme
+    to: [/dest1]
+    ` + test.durability + `
+`
+
+		// When
+		cfg, err := ReadConfiguration(yaml)
+
+		// Then
+		if test.valid && err != nil {
+			t.Errorf("Error reading configuration with %s: %s", test.durability, err)
+		}
+
+		if !test.valid && err == nil {
+			t.Errorf("Expected error with %s, got nothing", test.durability)
+		}
+
+		if test.valid && !cfg.FileFlows[0].Durable {
+			t.Errorf("Expected a durable flow with %s", test.durability)
+		}
+	}
+}
+
+func TestSFTPKeepAliveConfigurationRead(t *testing.T) {
+	var tests = []struct {
+		keepAlive string
+		expected  int
+	}{
+		{"", 30},
+		{"sftp_keepalive: 10", 10},
+		{"sftp_keepalive: -1", 0},
+	}
+
+	for _, test := range tests {
+		// Given
+		yaml := test.keepAlive + `
+file_flows:
+  - name: Move ACME files
+    from: /home/user/fileflow/acme
+    to: [/dest1]
+`
+
+		// When
+		cfg, err := ReadConfiguration(yaml)
+
+		// Then
+		if err != nil {
+			t.Fatalf("Error reading configuration with %q: %s", test.keepAlive, err)
+		}
+
+		if cfg.SFTPKeepAlive != test.expected {
+			t.Errorf("Expected keepalive %d with %q, got %d", test.expected, test.keepAlive, cfg.SFTPKeepAlive)
+		}
+	}
+}
+
+func TestSharedJournalIsRejected(t *testing.T) {
+	// Given
+	yaml := `
+file_flows:
+  - name: Move ACME files
+    from: /home/user/fileflow/acme
+    to: [/dest1]
+    durable: true
+    journal: /var/lib/fileflow/fileflow.journal
+  - name: Move Wayne files
+    from: /home/user/fileflow/wayne
+    to: [/dest2]
+    durable: true
+    journal: /var/lib/fileflow/../fileflow/fileflow.journal
+`
+
+	// When
+	_, err := ReadConfiguration(yaml)
+
+	// Then
+	if err == nil {
+		t.Errorf("Expected error with a journal shared by two flows, got nothing")
+	}
+}
+
 func TestDestinationFound(t *testing.T) {
 	// Given
 	pattern := ".+"
-	flow := FileFlow{"Move ACME files",
-		"localhost", 22, "sftp/acme", "privateKeyFile", pattern,
-		[]string{"/dest"}, regexp.MustCompile(pattern), Move, 0, ""}
+	flow := FileFlow{Name: "Move ACME files",
+		Server: "localhost", Port: 22, PrivateKeyPath: "sftp/acme", SourceFolder: "privateKeyFile", Pattern: pattern,
+		DestinationFolders: []string{"/dest"}, Regexp: regexp.MustCompile(pattern), Operation: Move}
 
 	// When
 	d := flow.destination("file_A")
@@ -168,8 +380,9 @@ func TestDestinationFound(t *testing.T) {
 func TestDestinationNotFound(t *testing.T) {
 	// Given
 	pattern := "foo_.+"
-	flow := FileFlow{"Move ACME files", "localhost", 22, "privateKeyFile", "sftp/acme", pattern,
-		[]string{"/dest"}, regexp.MustCompile(pattern), Move, 0, ""}
+	flow := FileFlow{Name: "Move ACME files", Server: "localhost", Port: 22, PrivateKeyPath: "privateKeyFile",
+		SourceFolder: "sftp/acme", Pattern: pattern, DestinationFolders: []string{"/dest"},
+		Regexp: regexp.MustCompile(pattern), Operation: Move}
 
 	// When
 	d := flow.destination("file_A")
@@ -179,3 +392,30 @@ func TestDestinationNotFound(t *testing.T) {
 		t.Errorf("Expected no destination action, got %s", d)
 	}
 }
+
+func TestInTimeWindow(t *testing.T) {
+	var tests = []struct {
+		from, to time.Duration
+		hour     int
+		inWindow bool
+	}{
+		{8 * time.Hour, 18 * time.Hour, 8, true},
+		{8 * time.Hour, 18 * time.Hour, 18, false},
+		{20 * time.Hour, 6 * time.Hour, 0, true},
+		{20 * time.Hour, 6 * time.Hour, 6, false},
+		{8 * time.Hour, 8 * time.Hour, 8, false},
+	}
+
+	for _, test := range tests {
+		// Given
+		now := time.Date(2023, 6, 1, test.hour, 0, 0, 0, time.Local)
+
+		// When
+		inWindow := InTimeWindow(test.from, test.to, now)
+
+		// Then
+		if inWindow != test.inWindow {
+			t.Errorf("Expected %v at %dh for window %v-%v, got %v", test.inWindow, test.hour, test.from, test.to, inWindow)
+		}
+	}
+}
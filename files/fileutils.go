@@ -1,22 +1,109 @@
 package files
 
 import (
+	"errors"
 	"io/fs"
 	"os"
+	"strings"
 )
 
+// ErrFreeSpaceUnsupported is returned by FreeSpace when the platform can't tell the free space of a filesystem.
+var ErrFreeSpaceUnsupported = errors.New("free space is not supported on this platform")
+
+// TempSuffix ends the names of the temporary files written by FileFlow while transferring files.
+// It's distinctive enough to not be mistaken for the files of the users.
+const TempSuffix = ".fileflow.tmp"
+
+// TempFile returns the path of the temporary file of a transfer to the file path.
+func TempFile(path string) string {
+	return path + TempSuffix
+}
+
+// TempFileTarget returns the path of the file a temporary file is written for.
+func TempFileTarget(tmp string) string {
+	return strings.TrimSuffix(tmp, TempSuffix)
+}
+
+// IsTempFile tells if the file name is the one of a temporary file of a transfer in progress.
+func IsTempFile(name string) bool {
+	return strings.HasSuffix(name, TempSuffix)
+}
+
+// CountFiles returns the number of regular files in the folder and its subfolders. Temporary files are not included.
+// If the folder can't be read, -1 is returned.
 func CountFiles(folder string) int {
-	dir, err := fs.ReadDir(os.DirFS(folder), ".")
-	if err != nil {
+	count := 0
+	if err := walkFiles(folder, func(fs.DirEntry) {
+		count++
+	}); err != nil {
 		return -1
 	}
+	return count
+}
 
-	count := 0
-	for _, file := range dir {
-		if file.Type().IsRegular() {
-			count++
+// FolderSize returns the total size in bytes of the regular files in the folder and its subfolders.
+// Temporary files are not included. If the folder can't be read, -1 is returned.
+func FolderSize(folder string) int64 {
+	var size int64
+	if err := walkFiles(folder, func(file fs.DirEntry) {
+		if info, err := file.Info(); err == nil {
+			size += info.Size()
+		}
+	}); err != nil {
+		return -1
+	}
+	return size
+}
+
+// walkFiles calls fn for each regular file of the folder and its subfolders, temporary files excluded.
+// The subfolders that can't be read are skipped. An error is returned only if the folder itself can't be read.
+func walkFiles(folder string, fn func(file fs.DirEntry)) error {
+	return fs.WalkDir(os.DirFS(folder), ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == "." {
+				return err
+			}
+			return fs.SkipDir
+		}
+		if d.Type().IsRegular() && !IsTempFile(d.Name()) {
+			fn(d)
+		}
+		return nil
+	})
+}
+
+// ContainsFiles tells if the folder or one of its subfolders holds a regular file. Temporary files are not included.
+// A folder that can't be read holds no file.
+func ContainsFiles(folder string) bool {
+	found := errors.New("found")
+	err := fs.WalkDir(os.DirFS(folder), ".", func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fs.SkipDir
+		}
+		if d.Type().IsRegular() && !IsTempFile(d.Name()) {
+			return found
 		}
+		return nil
+	})
+	return err == found
+}
+
+// SyncFile commits the content of the file to the storage.
+func SyncFile(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
 	}
+	defer f.Close()
+	return f.Sync()
+}
 
-	return count
+// SyncDir commits the entries of the folder (the created, renamed or removed files) to the storage.
+func SyncDir(folder string) error {
+	d, err := os.Open(folder)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
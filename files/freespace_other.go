@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package files
+
+// FreeSpace is not supported on this platform. It always returns ErrFreeSpaceUnsupported.
+func FreeSpace(_ string) (int64, error) {
+	return -1, ErrFreeSpaceUnsupported
+}
@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package files
+
+import "syscall"
+
+// FreeSpace returns the number of bytes available to an unprivileged user on the filesystem of the folder.
+func FreeSpace(folder string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(folder, &stat); err != nil {
+		return -1, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
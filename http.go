@@ -0,0 +1,122 @@
+package main
+
+import (
+	"FileFlow/metrics"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// serveHTTP starts an HTTP listener serving the handler: the control API of the daemon or the metrics.
+// It returns once the listener is open, the requests are served in the background.
+func serveHTTP(address string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("cannot listen on %s: %w", address, err)
+	}
+	slog.Info("Serving HTTP", "address", listener.Addr().String())
+
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			slog.Warn("HTTP listener stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// newHTTPHandler returns the handler of the HTTP API:
+//
+//	GET  /metrics                the Prometheus metrics, when m isn't nil
+//	GET  /flows                  the state of all the flows
+//	GET  /flows/{name}           the state of a flow
+//	POST /flows/{name}/pause     pauses a flow after its cycle in progress
+//	POST /flows/{name}/resume    resumes a paused flow
+//	POST /flows/{name}/run       starts a cycle of a flow now
+//	POST /shutdown               stops all the flows after their transfers in progress
+func newHTTPHandler(m *metrics.Metrics, d *daemon) http.Handler {
+	mux := http.NewServeMux()
+	if m != nil {
+		mux.Handle("/metrics", m.Handler())
+	}
+	mux.HandleFunc("/flows", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+			return
+		}
+		statuses := make([]flowStatus, len(d.runners))
+		for i, runner := range d.runners {
+			statuses[i] = runner.status()
+		}
+		writeJSON(w, http.StatusOK, statuses)
+	})
+	mux.HandleFunc("/flows/", func(w http.ResponseWriter, req *http.Request) {
+		handleFlow(w, req, d)
+	})
+	mux.HandleFunc("/shutdown", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			httpError(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+			return
+		}
+		d.shutdown()
+		writeJSON(w, http.StatusAccepted, map[string]string{"state": "shutting down"})
+	})
+	return mux
+}
+
+// handleFlow serves the requests about a flow: /flows/{name} and /flows/{name}/{action}.
+func handleFlow(w http.ResponseWriter, req *http.Request, d *daemon) {
+	name, action := strings.TrimPrefix(req.URL.Path, "/flows/"), ""
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name, action = name[:i], name[i+1:]
+	}
+
+	runner := d.runner(name)
+	if runner == nil {
+		httpError(w, http.StatusNotFound, "flow %s not found", name)
+		return
+	}
+
+	if action == "" {
+		if req.Method != http.MethodGet {
+			httpError(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+			return
+		}
+		writeJSON(w, http.StatusOK, runner.status())
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		httpError(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	switch action {
+	case "pause":
+		runner.pause()
+	case "resume":
+		runner.resume()
+	case "run":
+		if !runner.runNow() {
+			httpError(w, http.StatusConflict, "flow %s is paused", name)
+			return
+		}
+	default:
+		httpError(w, http.StatusNotFound, "unknown action %s", action)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, runner.status())
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Warn("Cannot write HTTP response", "error", err)
+	}
+}
+
+func httpError(w http.ResponseWriter, status int, format string, args ...any) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
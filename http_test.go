@@ -0,0 +1,148 @@
+package main
+
+import (
+	"FileFlow/fileflows"
+	"FileFlow/metrics"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestDaemon(names ...string) *daemon {
+	runners := make([]*flowRunner, len(names))
+	for i, name := range names {
+		runners[i] = &flowRunner{flow: fileflows.FileFlow{Name: name}, trigger: make(chan struct{}, 1)}
+	}
+	return newDaemon(runners, time.Hour, time.Minute)
+}
+
+func TestHTTPFlowControl(t *testing.T) {
+	// Given
+	d := newTestDaemon("ACME", "Wayne Enterprises")
+	d.runners[0].last = &cycleResult{Success: true, Files: 5, Dispatched: 3}
+	handler := newHTTPHandler(nil, d)
+
+	var tests = []struct {
+		method string
+		path   string
+		status int
+		state  string
+	}{
+		{http.MethodGet, "/flows/ACME", http.StatusOK, stateIdle},
+		{http.MethodPost, "/flows/ACME/pause", http.StatusAccepted, statePaused},
+		{http.MethodPost, "/flows/ACME/run", http.StatusConflict, ""},
+		{http.MethodPost, "/flows/ACME/resume", http.StatusAccepted, stateIdle},
+		{http.MethodPost, "/flows/Wayne%20Enterprises/run", http.StatusAccepted, stateIdle},
+		{http.MethodPost, "/flows/Stark/run", http.StatusNotFound, ""},
+		{http.MethodPost, "/flows/ACME/stop", http.StatusNotFound, ""},
+		{http.MethodGet, "/flows/ACME/pause", http.StatusMethodNotAllowed, ""},
+	}
+
+	for _, test := range tests {
+		// When
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(test.method, test.path, nil))
+
+		// Then
+		if rec.Code != test.status {
+			t.Errorf("Expected status %d for %s %s, got %d", test.status, test.method, test.path, rec.Code)
+			continue
+		}
+
+		if test.state != "" {
+			var status flowStatus
+			if err := json.NewDecoder(rec.Body).Decode(&status); err != nil {
+				t.Fatalf("Error decoding response: %s", err)
+			}
+			if status.State != test.state {
+				t.Errorf("Expected state %s for %s %s, got %s", test.state, test.method, test.path, status.State)
+			}
+		}
+	}
+
+	if len(d.runners[1].trigger) != 1 {
+		t.Errorf("Expected a triggered cycle for flow Wayne Enterprises")
+	}
+}
+
+func TestHTTPFlowList(t *testing.T) {
+	// Given
+	d := newTestDaemon("ACME", "Wayne Enterprises")
+	d.runners[0].last = &cycleResult{Success: true, Files: 5, Dispatched: 3}
+	handler := newHTTPHandler(nil, d)
+
+	// When
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/flows", nil))
+
+	// Then
+	var statuses []flowStatus
+	if err := json.NewDecoder(rec.Body).Decode(&statuses); err != nil {
+		t.Fatalf("Error decoding response: %s", err)
+	}
+
+	if len(statuses) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(statuses))
+	}
+
+	if statuses[0].Backlog != 2 || statuses[0].LastCycle == nil || !statuses[0].LastCycle.Success {
+		t.Errorf("Expected a backlog of 2 files after a successful cycle, got %+v", statuses[0])
+	}
+
+	if statuses[1].LastCycle != nil {
+		t.Errorf("Expected no cycle for flow %s, got %+v", statuses[1].Name, statuses[1].LastCycle)
+	}
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	// Given
+	d := newTestDaemon("ACME")
+
+	var tests = []struct {
+		metrics *metrics.Metrics
+		code    int
+	}{
+		{metrics.New(), http.StatusOK},
+		{nil, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		// When
+		rec := httptest.NewRecorder()
+		newHTTPHandler(test.metrics, d).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+		// Then
+		if rec.Code != test.code {
+			t.Errorf("Expected status %d, got %d", test.code, rec.Code)
+		}
+	}
+}
+
+func TestHTTPShutdown(t *testing.T) {
+	// Given
+	d := newTestDaemon("ACME")
+	handler := newHTTPHandler(nil, d)
+	done := make(chan struct{})
+	go func() {
+		d.run()
+		close(done)
+	}()
+
+	// When
+	d.runners[0].pause()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/shutdown", nil))
+
+	// Then
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("Expected status %d, got %d", http.StatusAccepted, rec.Code)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the flows to be finished")
+	}
+}
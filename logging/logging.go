@@ -0,0 +1,87 @@
+// Package logging sets up the structured logs of FileFlow.
+package logging
+
+import (
+	"FileFlow/fileflows"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Redacted replaces the value of the sensitive attributes.
+const Redacted = "[REDACTED]"
+
+// sensitiveKeys are the attributes whose value is always redacted. The attributes whose key ends with one of them are
+// redacted too (ssh_password for instance).
+var sensitiveKeys = []string{"private_key_path", "private_key", "password", "secret", "token", "passphrase"}
+
+// New creates the logger writing to w with the level and format of the configuration.
+// The values of the sensitive attributes and of the attributes listed by the configuration are redacted.
+func New(w io.Writer, config fileflows.LogConfig) (*slog.Logger, error) {
+	var level slog.Level
+	if config.Level != "" {
+		if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %s: %w", config.Level, err)
+		}
+	}
+
+	redacted := append(append([]string{}, sensitiveKeys...), config.Redact...)
+	options := &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() != slog.KindGroup && isSensitive(a.Key, redacted) {
+				return slog.String(a.Key, Redacted)
+			}
+			if group, ok := valuersGroup(a.Value); ok {
+				return slog.Attr{Key: a.Key, Value: group}
+			}
+			return a
+		},
+	}
+
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %s: expected text or json", config.Format)
+}
+
+func isSensitive(key string, redacted []string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range redacted {
+		if strings.HasSuffix(key, strings.ToLower(sensitive)) {
+			return true
+		}
+	}
+	return false
+}
+
+var logValuerType = reflect.TypeOf((*slog.LogValuer)(nil)).Elem()
+
+// valuersGroup returns a slice of slog.LogValuer as a group of its elements keyed by their index. slog doesn't resolve
+// the elements of a slice, so their sensitive attributes would be logged as they are.
+func valuersGroup(v slog.Value) (slog.Value, bool) {
+	if v.Kind() != slog.KindAny {
+		return v, false
+	}
+	slice := reflect.ValueOf(v.Any())
+	if slice.Kind() != reflect.Slice || !slice.Type().Elem().Implements(logValuerType) {
+		return v, false
+	}
+
+	attrs := make([]slog.Attr, slice.Len())
+	for i := range attrs {
+		attrs[i] = slog.Any(strconv.Itoa(i), slice.Index(i).Interface())
+	}
+	return slog.GroupValue(attrs...), true
+}
+
+// ForFlow returns the default logger with the flow name on every record.
+func ForFlow(name string) *slog.Logger {
+	return slog.With("flow", name)
+}
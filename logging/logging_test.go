@@ -0,0 +1,134 @@
+package logging
+
+import (
+	"FileFlow/fileflows"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSensitiveAttributesAreRedacted(t *testing.T) {
+	// Given
+	var out bytes.Buffer
+	logger, err := New(&out, fileflows.LogConfig{Format: "json", Redact: []string{"account"}})
+	if err != nil {
+		t.Fatalf("Error creating logger: %s", err)
+	}
+	flow := fileflows.FileFlow{Name: "ACME", Server: "localhost", Port: 22, PrivateKeyPath: "/home/acme/.ssh/id_rsa"}
+
+	// When
+	logger.Info("Used configuration", "flow", flow, "ssh_password", "secret!", "account", "acme", "file", "a.csv")
+
+	// Then
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Error reading record %s: %s", out.String(), err)
+	}
+	if strings.Contains(out.String(), "id_rsa") || strings.Contains(out.String(), "secret!") {
+		t.Errorf("Sensitive values are logged: %s", out.String())
+	}
+	if got := record["flow"].(map[string]any)["private_key_path"]; got != Redacted {
+		t.Errorf("Expected redacted private key path, got %v", got)
+	}
+	if got := record["flow"].(map[string]any)["name"]; got != "ACME" {
+		t.Errorf("Expected flow name ACME, got %v", got)
+	}
+	if record["ssh_password"] != Redacted || record["account"] != Redacted {
+		t.Errorf("Expected redacted password and account, got %v and %v", record["ssh_password"], record["account"])
+	}
+	if record["file"] != "a.csv" {
+		t.Errorf("Expected file a.csv, got %v", record["file"])
+	}
+}
+
+func TestSensitiveAttributesOfSliceAreRedacted(t *testing.T) {
+	// Given
+	var out bytes.Buffer
+	logger, err := New(&out, fileflows.LogConfig{Format: "json"})
+	if err != nil {
+		t.Fatalf("Error creating logger: %s", err)
+	}
+	flows := []fileflows.FileFlow{{Name: "ACME", PrivateKeyPath: "/secret/id_rsa"}, {Name: "Wayne", PrivateKeyPath: "/secret/id_ed25519"}}
+
+	// When
+	logger.Info("Used configuration", "flows", flows)
+
+	// Then
+	if strings.Contains(out.String(), "/secret/") {
+		t.Errorf("Sensitive values are logged: %s", out.String())
+	}
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("Error reading record %s: %s", out.String(), err)
+	}
+	if got := record["flows"].(map[string]any)["1"].(map[string]any)["name"]; got != "Wayne" {
+		t.Errorf("Expected second flow Wayne, got %v", got)
+	}
+}
+
+func TestLevelAndFormat(t *testing.T) {
+	var tests = []struct {
+		config   fileflows.LogConfig
+		expected string
+		valid    bool
+	}{
+		{fileflows.LogConfig{}, "level=INFO msg=info\nlevel=WARN msg=warn\n", true},
+		{fileflows.LogConfig{Level: "warn", Format: "text"}, "level=WARN msg=warn\n", true},
+		{fileflows.LogConfig{Level: "debug"}, "level=DEBUG msg=debug\nlevel=INFO msg=info\nlevel=WARN msg=warn\n", true},
+		{fileflows.LogConfig{Level: "error", Format: "json"}, "", true},
+		{fileflows.LogConfig{Level: "verbose"}, "", false},
+		{fileflows.LogConfig{Format: "xml"}, "", false},
+	}
+
+	for _, test := range tests {
+		// Given
+		var out bytes.Buffer
+		logger, err := New(&out, test.config)
+		if (err == nil) != test.valid {
+			t.Errorf("Configuration %+v: expected valid %v, got error %v", test.config, test.valid, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		// When
+		logger.Debug("debug")
+		logger.Info("info")
+		logger.Warn("warn")
+
+		// Then
+		got := withoutTime(out.String())
+		if got != test.expected {
+			t.Errorf("Configuration %+v: expected logs %q, got %q", test.config, test.expected, got)
+		}
+	}
+}
+
+func TestForFlow(t *testing.T) {
+	// Given
+	var out bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&out, nil)))
+
+	// When
+	ForFlow("ACME").Info("Moving file", "file", "a.csv")
+
+	// Then
+	if got := withoutTime(out.String()); got != "level=INFO msg=\"Moving file\" flow=ACME file=a.csv\n" {
+		t.Errorf("Expected flow attribute, got %q", got)
+	}
+}
+
+// withoutTime removes the time attribute of the text records.
+func withoutTime(logs string) string {
+	lines := strings.SplitAfter(logs, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "time=") {
+			lines[i] = line[strings.Index(line, " ")+1:]
+		}
+	}
+	return strings.Join(lines, "")
+}
@@ -0,0 +1,118 @@
+// Package metrics exposes the FileFlow metrics to Prometheus.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"time"
+)
+
+// DispatchBuckets are the buckets of the dispatch latency histogram, in seconds.
+var DispatchBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900}
+
+// Metrics are the FileFlow metrics, with the metrics of the process and of the Go runtime. A nil Metrics measures
+// nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	files         *prometheus.CounterVec
+	bytes         *prometheus.CounterVec
+	failures      *prometheus.CounterVec
+	overflowed    *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+	fill          *prometheus.GaugeVec
+	cycleDuration *prometheus.GaugeVec
+	lastSuccess   *prometheus.GaugeVec
+	expectations  *prometheus.CounterVec
+}
+
+// New creates the FileFlow metrics into a new registry. The metrics are registered as they are created.
+func New() *Metrics {
+	r := prometheus.NewRegistry()
+	r.MustRegister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}), collectors.NewGoCollector())
+	factory := promauto.With(r)
+	return &Metrics{
+		registry: r,
+		files: factory.NewCounterVec(prometheus.CounterOpts{Name: "fileflow_transferred_files_total",
+			Help: "Number of files transferred."}, []string{"flow", "operation"}),
+		bytes: factory.NewCounterVec(prometheus.CounterOpts{Name: "fileflow_transferred_bytes_total",
+			Help: "Number of bytes of the transferred source files."}, []string{"flow", "operation"}),
+		failures: factory.NewCounterVec(prometheus.CounterOpts{Name: "fileflow_failures_total",
+			Help: "Number of failed dispatches by error type."}, []string{"flow", "error"}),
+		overflowed: factory.NewCounterVec(prometheus.CounterOpts{Name: "fileflow_overflowed_files_total",
+			Help: "Number of files moved into an overflow folder."}, []string{"flow"}),
+		latency: factory.NewHistogramVec(prometheus.HistogramOpts{Name: "fileflow_dispatch_duration_seconds",
+			Help: "Duration of the dispatch of a file.", Buckets: DispatchBuckets}, []string{"flow"}),
+		fill: factory.NewGaugeVec(prometheus.GaugeOpts{Name: "fileflow_folder_fill_ratio",
+			Help: "Used part of the capacity of a destination folder, from 0 (empty) to 1 (full)."},
+			[]string{"flow", "folder"}),
+		cycleDuration: factory.NewGaugeVec(prometheus.GaugeOpts{Name: "fileflow_cycle_duration_seconds",
+			Help: "Duration of the last cycle of a flow."}, []string{"flow"}),
+		lastSuccess: factory.NewGaugeVec(prometheus.GaugeOpts{Name: "fileflow_last_success_timestamp_seconds",
+			Help: "Unix time of the end of the last successful cycle of a flow."}, []string{"flow"}),
+		expectations: factory.NewCounterVec(prometheus.CounterOpts{Name: "fileflow_expectations_total",
+			Help: "Number of expected deliveries by status."}, []string{"flow", "expectation", "status"}),
+	}
+}
+
+// Handler returns the HTTP handler serving the metrics to Prometheus.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Transferred measures a file delivered into a destination folder.
+func (m *Metrics) Transferred(flow string, operation string, size int64, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.files.WithLabelValues(flow, operation).Inc()
+	m.bytes.WithLabelValues(flow, operation).Add(float64(size))
+	m.latency.WithLabelValues(flow).Observe(duration.Seconds())
+}
+
+// Overflowed measures a file moved into an overflow folder.
+func (m *Metrics) Overflowed(flow string, duration time.Duration) {
+	if m == nil {
+		return
+	}
+	m.overflowed.WithLabelValues(flow).Inc()
+	m.latency.WithLabelValues(flow).Observe(duration.Seconds())
+}
+
+// Failed measures a failed dispatch.
+func (m *Metrics) Failed(flow string, errorType string) {
+	if m == nil {
+		return
+	}
+	m.failures.WithLabelValues(flow, errorType).Inc()
+}
+
+// FolderFill measures the fill level of a destination folder.
+func (m *Metrics) FolderFill(flow string, folder string, fill float64) {
+	if m == nil {
+		return
+	}
+	m.fill.WithLabelValues(flow, folder).Set(fill)
+}
+
+// Cycle measures a cycle of a flow. The end of the successful cycles is kept.
+func (m *Metrics) Cycle(flow string, duration time.Duration, success bool) {
+	if m == nil {
+		return
+	}
+	m.cycleDuration.WithLabelValues(flow).Set(duration.Seconds())
+	if success {
+		m.lastSuccess.WithLabelValues(flow).Set(float64(time.Now().Unix()))
+	}
+}
+
+// Expectation measures the status of an expected delivery of a flow.
+func (m *Metrics) Expectation(flow string, expectation string, status string) {
+	if m == nil {
+		return
+	}
+	m.expectations.WithLabelValues(flow, expectation, status).Inc()
+}
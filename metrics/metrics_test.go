@@ -0,0 +1,66 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	// Given
+	m := New()
+	m.Transferred("ACME", "move", 1024, 200*time.Millisecond)
+	m.Transferred("ACME", "move", 2048, 2*time.Second)
+	m.Overflowed("ACME", 20*time.Millisecond)
+	m.Failed("ACME", "not_found")
+	m.FolderFill("ACME", `/dest "1"`, 0.5)
+	m.Cycle("ACME", 3*time.Second, true)
+	m.Expectation("ACME", "Daily report", "missed")
+
+	// When
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	// Then
+	if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("Expected Prometheus text format, got %s", rec.Header().Get("Content-Type"))
+	}
+
+	body := rec.Body.String()
+	expected := []string{
+		"# TYPE fileflow_transferred_files_total counter",
+		`fileflow_transferred_files_total{flow="ACME",operation="move"} 2`,
+		`fileflow_transferred_bytes_total{flow="ACME",operation="move"} 3072`,
+		`fileflow_failures_total{error="not_found",flow="ACME"} 1`,
+		`fileflow_overflowed_files_total{flow="ACME"} 1`,
+		"# TYPE fileflow_dispatch_duration_seconds histogram",
+		`fileflow_dispatch_duration_seconds_bucket{flow="ACME",le="0.05"} 1`,
+		`fileflow_dispatch_duration_seconds_bucket{flow="ACME",le="0.5"} 2`,
+		`fileflow_dispatch_duration_seconds_bucket{flow="ACME",le="+Inf"} 3`,
+		`fileflow_dispatch_duration_seconds_count{flow="ACME"} 3`,
+		`fileflow_folder_fill_ratio{flow="ACME",folder="/dest \"1\""} 0.5`,
+		`fileflow_cycle_duration_seconds{flow="ACME"} 3`,
+		`fileflow_last_success_timestamp_seconds{flow="ACME"} `,
+		`fileflow_expectations_total{expectation="Daily report",flow="ACME",status="missed"} 1`,
+		"# TYPE go_goroutines gauge",
+	}
+	for _, line := range expected {
+		if !strings.Contains(body, line) {
+			t.Errorf("Expected %s in metrics, got:\n%s", line, body)
+		}
+	}
+}
+
+func TestNilMetrics(t *testing.T) {
+	// Given
+	var m *Metrics
+
+	// When
+	m.Transferred("ACME", "move", 1024, time.Second)
+	m.Failed("ACME", "other")
+	m.Cycle("ACME", time.Second, true)
+	m.Expectation("ACME", "Daily report", "late")
+
+	// Then no panic
+}
@@ -0,0 +1,198 @@
+package notify
+
+import (
+	"FileFlow/fileflows"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultEmailEvents are the events alerted by email when the configuration selects none: the failures.
+var defaultEmailEvents = []string{FileFailed, DestinationFull, ConnectionFailed, NoFileReceived, ExpectationMissed,
+	ExpectationLate}
+
+// defaultSMTPPort is the port of the SMTP server when the configuration sets none.
+const defaultSMTPPort = 25
+
+// smtpTimeout bounds the connection to the SMTP server and the sending of an email.
+var smtpTimeout = 30 * time.Second
+
+// Email sends the events as email alerts through a SMTP server. The alerts are sent in the background, immediately
+// or gathered into digests: the events notified while the queue is full are dropped.
+type Email struct {
+	config fileflows.EmailConfig
+	addr   string
+	filter Filter
+	digest time.Duration
+
+	queue chan Event
+	done  chan struct{}
+}
+
+// NewEmail creates the email alerts of the configuration and starts sending them.
+func NewEmail(config fileflows.EmailConfig) (*Email, error) {
+	if config.Server == "" || config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("email needs a server, a from address and to addresses")
+	}
+	filter := Filter{Events: config.Events, Flows: config.Flows}
+	if len(filter.Events) == 0 {
+		filter.Events = defaultEmailEvents
+	}
+	if err := filter.validate(); err != nil {
+		return nil, fmt.Errorf("email: %w", err)
+	}
+
+	e := &Email{
+		config: config,
+		addr:   net.JoinHostPort(config.Server, strconv.Itoa(orDefault(config.Port, defaultSMTPPort))),
+		filter: filter,
+		digest: time.Duration(config.Digest) * time.Second,
+		queue:  make(chan Event, queueSize),
+		done:   make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+// Notify queues the event if the email alerts select it.
+func (e *Email) Notify(event Event) {
+	if !e.filter.Matches(event) {
+		return
+	}
+	select {
+	case e.queue <- event:
+	default:
+		slog.Warn("Email queue is full, dropping event", "server", e.addr, "flow", event.Flow, "event", event.Type)
+	}
+}
+
+// Close stops the email alerts once the queued events are sent, the pending digest included, or when the context is
+// done: the events left are then dropped. No event must be notified after.
+func (e *Email) Close(ctx context.Context) error {
+	close(e.queue)
+	select {
+	case <-e.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("email %s: %w", e.addr, ctx.Err())
+	}
+}
+
+func (e *Email) run() {
+	defer close(e.done)
+	if e.digest <= 0 {
+		for event := range e.queue {
+			e.send(event.Message(), []Event{event})
+		}
+		return
+	}
+
+	ticker := time.NewTicker(e.digest)
+	defer ticker.Stop()
+	var pending []Event
+	for {
+		select {
+		case event, ok := <-e.queue:
+			if !ok {
+				e.sendDigest(pending)
+				return
+			}
+			pending = append(pending, event)
+		case <-ticker.C:
+			e.sendDigest(pending)
+			pending = nil
+		}
+	}
+}
+
+func (e *Email) sendDigest(events []Event) {
+	if len(events) == 0 {
+		return
+	}
+	e.send(fmt.Sprintf("%d FileFlow events", len(events)), events)
+}
+
+// send sends an email with the subject and the events.
+func (e *Email) send(subject string, events []Event) {
+	if err := e.sendMail(message(e.config.From, e.config.To, subject, events)); err != nil {
+		slog.Warn("Cannot send email", "server", e.addr, "events", len(events), "error", err)
+	}
+}
+
+// sendMail sends the message to the recipients, upgrading the connection with STARTTLS and authenticating if the
+// configuration says so.
+func (e *Email) sendMail(msg []byte) error {
+	conn, err := net.DialTimeout("tcp", e.addr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		_ = conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, e.config.Server)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if e.config.StartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: e.config.Server}); err != nil {
+			return fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	if e.config.Username != "" {
+		auth := smtp.PlainAuth("", e.config.Username, e.config.Password, e.config.Server)
+		if err := c.Auth(auth); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	if err := c.Mail(e.config.From); err != nil {
+		return err
+	}
+	for _, to := range e.config.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message builds the email of the events, one line per event.
+func message(from string, to []string, subject string, events []Event) []byte {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: [FileFlow] %s\r\n", headerValue(subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	for _, event := range events {
+		fmt.Fprintf(&msg, "%s %s\r\n", event.Time.Format(time.RFC3339), event.Message())
+	}
+	return msg.Bytes()
+}
+
+// headerValue removes the line breaks of a header value.
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
@@ -0,0 +1,211 @@
+package notify
+
+import (
+	"FileFlow/fileflows"
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// smtpServer is a local SMTP stand-in recording the received messages.
+type smtpServer struct {
+	listener net.Listener
+	mu       sync.Mutex
+	messages []smtpMessage
+}
+
+type smtpMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	s := &smtpServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { _ = listener.Close() })
+	return s
+}
+
+func (s *smtpServer) config() fileflows.EmailConfig {
+	addr := s.listener.Addr().(*net.TCPAddr)
+	return fileflows.EmailConfig{Server: "127.0.0.1", Port: addr.Port, From: "fileflow@example.com",
+		To: []string{"ops@example.com", "partners@example.com"}}
+}
+
+func (s *smtpServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+
+	var msg smtpMessage
+	reply("220 localhost ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.TrimSpace(line))
+		switch {
+		case strings.HasPrefix(command, "EHLO"), strings.HasPrefix(command, "HELO"):
+			reply("250 localhost")
+		case strings.HasPrefix(command, "MAIL FROM:"):
+			msg = smtpMessage{from: strings.Trim(strings.TrimSpace(line)[10:], "<>")}
+			reply("250 OK")
+		case strings.HasPrefix(command, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(strings.TrimSpace(line)[8:], "<>"))
+			reply("250 OK")
+		case command == "DATA":
+			reply("354 End data with <CR><LF>.<CR><LF>")
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+			msg.data = data.String()
+			s.mu.Lock()
+			s.messages = append(s.messages, msg)
+			s.mu.Unlock()
+			reply("250 OK")
+		case command == "QUIT":
+			reply("221 Bye")
+			return
+		default:
+			reply("502 Command not implemented")
+		}
+	}
+}
+
+func TestEmailAlertsImmediately(t *testing.T) {
+	// Given
+	server := newSMTPServer(t)
+	email, err := NewEmail(server.config())
+	if err != nil {
+		t.Fatalf("Error creating email alerts: %s", err)
+	}
+
+	// When
+	email.Notify(Event{Type: FileDelivered, Flow: "ACME", Source: "sftp/acme/file_A.csv"})
+	email.Notify(Event{Type: FileFailed, Flow: "ACME", Source: "sftp/acme/file_B.csv", Error: "no space left on device"})
+	_ = email.Close(context.Background())
+
+	// Then
+	if len(server.messages) != 1 {
+		t.Fatalf("Expected 1 email, got %d", len(server.messages))
+	}
+	msg := server.messages[0]
+	if msg.from != "fileflow@example.com" || strings.Join(msg.to, ",") != "ops@example.com,partners@example.com" {
+		t.Errorf("Expected email from fileflow@example.com to ops and partners, got %s to %v", msg.from, msg.to)
+	}
+	subject := "Subject: [FileFlow] Flow ACME failed to deliver sftp/acme/file_B.csv: no space left on device\r\n"
+	if !strings.Contains(msg.data, subject) {
+		t.Errorf("Expected subject %q, got email %q", subject, msg.data)
+	}
+}
+
+func TestEmailDigest(t *testing.T) {
+	// Given
+	server := newSMTPServer(t)
+	config := server.config()
+	config.Digest = 3600
+	config.Events = []string{FileDelivered, NoFileReceived}
+	email, err := NewEmail(config)
+	if err != nil {
+		t.Fatalf("Error creating email alerts: %s", err)
+	}
+	since := time.Date(2023, 6, 1, 7, 0, 0, 0, time.UTC)
+
+	// When
+	email.Notify(Event{Type: FileDelivered, Flow: "ACME", Source: "sftp/acme/file_A.csv", Destination: "/dest/file_A.csv"})
+	email.Notify(Event{Type: FileFailed, Flow: "ACME", Source: "sftp/acme/file_B.csv"})
+	email.Notify(Event{Type: NoFileReceived, Flow: "Wayne", Since: &since})
+	_ = email.Close(context.Background())
+
+	// Then
+	if len(server.messages) != 1 {
+		t.Fatalf("Expected 1 digest, got %d", len(server.messages))
+	}
+	data := server.messages[0].data
+	for _, expected := range []string{
+		"Subject: [FileFlow] 2 FileFlow events\r\n",
+		"Flow ACME delivered sftp/acme/file_A.csv to /dest/file_A.csv\r\n",
+		"Flow Wayne received no file since 2023-06-01T07:00:00Z\r\n",
+	} {
+		if !strings.Contains(data, expected) {
+			t.Errorf("Expected %q in digest %q", expected, data)
+		}
+	}
+}
+
+func TestSilentSMTPServerTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) { smtpTimeout = timeout }(smtpTimeout)
+	smtpTimeout = 50 * time.Millisecond
+
+	// Given
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		// The server accepts the connections but never greets.
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { _ = conn.Close() })
+		}
+	}()
+	email, err := NewEmail(fileflows.EmailConfig{Server: "127.0.0.1", Port: listener.Addr().(*net.TCPAddr).Port,
+		From: "fileflow@example.com", To: []string{"ops@example.com"}})
+	if err != nil {
+		t.Fatalf("Error creating email alerts: %s", err)
+	}
+
+	// When
+	start := time.Now()
+	err = email.sendMail([]byte("Subject: test\r\n\r\ntest\r\n"))
+
+	// Then
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the sending to time out, got %v after %s", err, time.Since(start))
+	}
+	_ = email.Close(context.Background())
+}
+
+func TestEmailConfigurationErrors(t *testing.T) {
+	var tests = []fileflows.EmailConfig{
+		{Server: "localhost", From: "fileflow@example.com"},
+		{Server: "localhost", To: []string{"ops@example.com"}},
+		{Server: "localhost", From: "fileflow@example.com", To: []string{"ops@example.com"}, Events: []string{"file_lost"}},
+	}
+
+	for i, config := range tests {
+		if _, err := NewEmail(config); err == nil {
+			t.Errorf("Expected error for configuration %d", i)
+		}
+	}
+}
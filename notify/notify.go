@@ -0,0 +1,138 @@
+// Package notify notifies the events of the flows: file deliveries, overflows, connection failures, etc.
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Types of the events.
+const (
+	FileDelivered     = "file_delivered"
+	FileFailed        = "file_failed"
+	OverflowStarted   = "overflow_started"
+	DestinationFull   = "destination_full"
+	ConnectionFailed  = "connection_failed"
+	FlowRecovered     = "flow_recovered"
+	NoFileReceived    = "no_file_received"
+	ExpectationMissed = "expectation_missed"
+	ExpectationLate   = "expectation_late"
+)
+
+// EventTypes are all the types of events.
+var EventTypes = []string{FileDelivered, FileFailed, OverflowStarted, DestinationFull, ConnectionFailed, FlowRecovered,
+	NoFileReceived, ExpectationMissed, ExpectationLate}
+
+// Event is something that happened to a flow.
+type Event struct {
+	Type        string     `json:"type"`
+	Time        time.Time  `json:"time"`
+	Flow        string     `json:"flow"`
+	Source      string     `json:"source,omitempty"`
+	Destination string     `json:"destination,omitempty"`
+	Folder      string     `json:"folder,omitempty"`
+	Size        int64      `json:"size,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	Since       *time.Time `json:"since,omitempty"`
+	Expectation string     `json:"expectation,omitempty"`
+	Deadline    *time.Time `json:"deadline,omitempty"`
+	Files       int        `json:"files,omitempty"`
+}
+
+// Message describes the event in a sentence.
+func (e Event) Message() string {
+	switch e.Type {
+	case FileDelivered:
+		return fmt.Sprintf("Flow %s delivered %s to %s", e.Flow, e.Source, e.Destination)
+	case FileFailed:
+		return fmt.Sprintf("Flow %s failed to deliver %s: %s", e.Flow, e.Source, e.Error)
+	case OverflowStarted:
+		return fmt.Sprintf("Flow %s destination folders are full, files overflow into %s", e.Flow, e.Folder)
+	case DestinationFull:
+		return fmt.Sprintf("Flow %s destination folders are full, %d files are waiting", e.Flow, e.Files)
+	case ConnectionFailed:
+		return fmt.Sprintf("Flow %s cannot connect to its server: %s", e.Flow, e.Error)
+	case FlowRecovered:
+		return fmt.Sprintf("Flow %s is running again", e.Flow)
+	case NoFileReceived:
+		if e.Since == nil {
+			return fmt.Sprintf("Flow %s received no file", e.Flow)
+		}
+		return fmt.Sprintf("Flow %s received no file since %s", e.Flow, e.Since.Format(time.RFC3339))
+	case ExpectationMissed:
+		return fmt.Sprintf("Flow %s missed expectation %s: %d files received by %s", e.Flow, e.Expectation, e.Files,
+			formatTime(e.Deadline))
+	case ExpectationLate:
+		return fmt.Sprintf("Flow %s met expectation %s late, after %s", e.Flow, e.Expectation, formatTime(e.Deadline))
+	}
+	return fmt.Sprintf("Flow %s: %s", e.Flow, e.Type)
+}
+
+// formatTime formats the deadline of the expectation events.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "the deadline"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Notifier notifies the events. Notify must not block the flows.
+type Notifier interface {
+	Notify(e Event)
+}
+
+// Notifiers notifies the events to all its notifiers.
+type Notifiers []Notifier
+
+// Notify notifies the event to all the notifiers.
+func (n Notifiers) Notify(e Event) {
+	for _, notifier := range n {
+		notifier.Notify(e)
+	}
+}
+
+// Close closes the notifiers sending their events in the background, once their pending events are sent or when the
+// context is done. It returns the errors of the notifiers whose pending events are dropped.
+func (n Notifiers) Close(ctx context.Context) error {
+	var errs []error
+	for _, notifier := range n {
+		if closer, ok := notifier.(interface{ Close(context.Context) error }); ok {
+			if err := closer.Close(ctx); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Filter selects events by type and flow. An empty list selects all the types or flows.
+type Filter struct {
+	Events []string
+	Flows  []string
+}
+
+// Matches tells if the filter selects the event.
+func (f Filter) Matches(e Event) bool {
+	return (len(f.Events) == 0 || contains(f.Events, e.Type)) && (len(f.Flows) == 0 || contains(f.Flows, e.Flow))
+}
+
+// validate checks that the filter only selects known types of events.
+func (f Filter) validate() error {
+	for _, event := range f.Events {
+		if !contains(EventTypes, event) {
+			return fmt.Errorf("unknown event %s, expected one of %v", event, EventTypes)
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package notify
+
+import (
+	"FileFlow/fileflows"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// Default settings of the webhooks.
+const (
+	defaultRetries    = 3
+	defaultRetryDelay = 1
+	defaultTimeout    = 10
+	queueSize         = 100
+)
+
+// retryDelayUnit is the unit of the retry delay setting.
+var retryDelayUnit = time.Second
+
+// Webhook posts the events as JSON to an HTTP endpoint. The events are sent in the background, one after the other:
+// the events notified while the queue is full are dropped.
+type Webhook struct {
+	url        string
+	filter     Filter
+	template   *template.Template
+	headers    map[string]string
+	retries    int
+	retryDelay time.Duration
+	client     *http.Client
+
+	queue chan Event
+	done  chan struct{}
+}
+
+// NewWebhook creates the webhook of the configuration and starts sending its events.
+func NewWebhook(config fileflows.WebhookConfig) (*Webhook, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("webhook needs an url")
+	}
+	filter := Filter{Events: config.Events, Flows: config.Flows}
+	if err := filter.validate(); err != nil {
+		return nil, fmt.Errorf("webhook %s: %w", config.URL, err)
+	}
+
+	retries := orDefault(config.Retries, defaultRetries)
+	if config.Retries < 0 {
+		retries = 0
+	}
+
+	w := &Webhook{
+		url:        config.URL,
+		filter:     filter,
+		headers:    config.Headers,
+		retries:    retries,
+		retryDelay: time.Duration(orDefault(config.RetryDelay, defaultRetryDelay)) * retryDelayUnit,
+		client:     &http.Client{Timeout: time.Duration(orDefault(config.Timeout, defaultTimeout)) * time.Second},
+		queue:      make(chan Event, queueSize),
+		done:       make(chan struct{}),
+	}
+	if config.Template != "" {
+		t, err := template.New(config.URL).Funcs(template.FuncMap{"json": toJSON}).Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s: invalid template: %w", config.URL, err)
+		}
+		w.template = t
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// Notify queues the event if the webhook selects it.
+func (w *Webhook) Notify(e Event) {
+	if !w.filter.Matches(e) {
+		return
+	}
+	select {
+	case w.queue <- e:
+	default:
+		slog.Warn("Webhook queue is full, dropping event", "url", w.url, "flow", e.Flow, "event", e.Type)
+	}
+}
+
+// Close stops the webhook once the queued events are sent, or when the context is done: the events left are then
+// dropped. No event must be notified after.
+func (w *Webhook) Close(ctx context.Context) error {
+	close(w.queue)
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("webhook %s: %w", w.url, ctx.Err())
+	}
+}
+
+func (w *Webhook) run() {
+	defer close(w.done)
+	for e := range w.queue {
+		if err := w.send(e); err != nil {
+			slog.Warn("Cannot notify webhook", "url", w.url, "flow", e.Flow, "event", e.Type, "error", err)
+		}
+	}
+}
+
+// send posts the event, retrying on network errors and on server errors.
+func (w *Webhook) send(e Event) error {
+	body, err := w.payload(e)
+	if err != nil {
+		return err
+	}
+
+	delay := w.retryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(body)
+		if err == nil || !retry || attempt >= w.retries {
+			return err
+		}
+		slog.Debug("Retrying webhook", "url", w.url, "event", e.Type, "attempt", attempt+1, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// payload returns the JSON body of the event: the rendered template, if any, or the event itself.
+func (w *Webhook) payload(e Event) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(e)
+	}
+
+	var body bytes.Buffer
+	if err := w.template.Execute(&body, e); err != nil {
+		return nil, fmt.Errorf("cannot render payload: %w", err)
+	}
+	if !json.Valid(body.Bytes()) {
+		return nil, fmt.Errorf("rendered payload is not JSON: %s", body.String())
+	}
+	return body.Bytes(), nil
+}
+
+// post sends the body to the webhook. It tells if the request can be retried when it fails.
+func (w *Webhook) post(body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return true, fmt.Errorf("status %s", resp.Status)
+	}
+	return false, fmt.Errorf("status %s", resp.Status)
+}
+
+// toJSON is the json function of the templates: it writes the value as JSON, quoted and escaped for strings.
+func toJSON(value any) (string, error) {
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+func orDefault(value int, defaultValue int) int {
+	if value <= 0 {
+		return defaultValue
+	}
+	return value
+}
@@ -0,0 +1,165 @@
+package notify
+
+import (
+	"FileFlow/fileflows"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookServer records the bodies of the requests and answers with the statuses, then with 200 OK.
+type webhookServer struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+}
+
+func (s *webhookServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bodies = append(s.bodies, string(body))
+	if len(s.statuses) > 0 {
+		w.WriteHeader(s.statuses[0])
+		s.statuses = s.statuses[1:]
+	}
+}
+
+func TestWebhookSendsSelectedEvents(t *testing.T) {
+	// Given
+	server := &webhookServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	webhook, err := NewWebhook(fileflows.WebhookConfig{URL: ts.URL, Events: []string{FileDelivered}, Flows: []string{"ACME"}})
+	if err != nil {
+		t.Fatalf("Error creating webhook: %s", err)
+	}
+	delivered := Event{Type: FileDelivered, Time: time.Date(2023, 6, 1, 7, 0, 0, 0, time.UTC), Flow: "ACME", Source: "sftp/acme/file_A.csv", Destination: "/dest/file_A.csv", Size: 42}
+
+	// When
+	webhook.Notify(delivered)
+	webhook.Notify(Event{Type: FileFailed, Flow: "ACME", Source: "sftp/acme/file_B.csv"})
+	webhook.Notify(Event{Type: FileDelivered, Flow: "Wayne", Source: "sftp/wayne/file_C.csv"})
+	_ = webhook.Close(context.Background())
+
+	// Then
+	if len(server.bodies) != 1 {
+		t.Fatalf("Expected 1 request, got %d: %v", len(server.bodies), server.bodies)
+	}
+	var got Event
+	if err := json.Unmarshal([]byte(server.bodies[0]), &got); err != nil {
+		t.Fatalf("Error reading payload %s: %s", server.bodies[0], err)
+	}
+	if got != delivered {
+		t.Errorf("Expected event %+v, got %+v", delivered, got)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	// Given
+	server := &webhookServer{}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	template := `{"text": {{ json .Message }}, "flow": {{ json .Flow }}}`
+	webhook, err := NewWebhook(fileflows.WebhookConfig{URL: ts.URL, Template: template})
+	if err != nil {
+		t.Fatalf("Error creating webhook: %s", err)
+	}
+
+	// When
+	webhook.Notify(Event{Type: ConnectionFailed, Flow: `ACME "partner"`, Error: "connection refused"})
+	_ = webhook.Close(context.Background())
+
+	// Then
+	expected := `{"text": "Flow ACME \"partner\" cannot connect to its server: connection refused", "flow": "ACME \"partner\""}`
+	if len(server.bodies) != 1 || server.bodies[0] != expected {
+		t.Errorf("Expected payload %s, got %v", expected, server.bodies)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	defer func(unit time.Duration) { retryDelayUnit = unit }(retryDelayUnit)
+	retryDelayUnit = time.Millisecond
+
+	var tests = []struct {
+		name     string
+		retries  int
+		statuses []int
+		requests int
+	}{
+		{"Success", 2, nil, 1},
+		{"Retried server errors", 2, []int{http.StatusInternalServerError, http.StatusTooManyRequests}, 3},
+		{"Retries exhausted", 2, []int{500, 502, 503, 504, 500}, 3},
+		{"Client error not retried", 2, []int{http.StatusBadRequest}, 1},
+		{"Default retries", 0, []int{500, 502, 503, 504, 500}, 4},
+		{"Retries disabled", -1, []int{http.StatusInternalServerError}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Given
+			server := &webhookServer{statuses: test.statuses}
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+			webhook, err := NewWebhook(fileflows.WebhookConfig{URL: ts.URL, Retries: test.retries})
+			if err != nil {
+				t.Fatalf("Error creating webhook: %s", err)
+			}
+
+			// When
+			webhook.Notify(Event{Type: FlowRecovered, Flow: "ACME"})
+			_ = webhook.Close(context.Background())
+
+			// Then
+			if len(server.bodies) != test.requests {
+				t.Errorf("Expected %d requests, got %d", test.requests, len(server.bodies))
+			}
+		})
+	}
+}
+
+func TestWebhookCloseIsBounded(t *testing.T) {
+	// Given
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+	webhook, err := NewWebhook(fileflows.WebhookConfig{URL: ts.URL})
+	if err != nil {
+		t.Fatalf("Error creating webhook: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// When
+	webhook.Notify(Event{Type: FlowRecovered, Flow: "ACME"})
+	start := time.Now()
+	err = webhook.Close(ctx)
+
+	// Then
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Errorf("Expected the close to stop at the deadline, got %v after %s", err, time.Since(start))
+	}
+}
+
+func TestWebhookConfigurationErrors(t *testing.T) {
+	var tests = []fileflows.WebhookConfig{
+		{},
+		{URL: "http://localhost", Events: []string{"file_lost"}},
+		{URL: "http://localhost", Template: "{{ .Flow "},
+	}
+
+	for _, config := range tests {
+		if _, err := NewWebhook(config); err == nil {
+			t.Errorf("Expected error for configuration %+v", config)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Package throttle limits the bandwidth used by the file transfers.
+package throttle
+
+import (
+	"FileFlow/fileflows"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// chunkSize is the maximum number of bytes read at once by a throttled reader.
+// Small chunks share the bandwidth fairly between the concurrent transfers.
+const chunkSize = 32 * 1024
+
+// Profile is a bandwidth limit applied during a window of the day.
+// From and To are durations since midnight (local time). When To is before From, the window goes over midnight.
+// A zero Rate means no limit during the window.
+type Profile struct {
+	From time.Duration
+	To   time.Duration
+	Rate int64
+}
+
+// Limiter is a token bucket limiting a flow of bytes to a rate in bytes per second.
+// A Limiter may be shared by many transfers: each one waits its turn for the bandwidth.
+type Limiter struct {
+	rate     int64
+	profiles []Profile
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+}
+
+// NewLimiter creates a Limiter with a default rate in bytes per second and the profiles changing the rate during
+// some windows of the day. The first profile containing the current time wins.
+// It returns nil when the Limiter would never limit anything.
+func NewLimiter(rate int64, profiles []Profile) *Limiter {
+	if rate == 0 && len(profiles) == 0 {
+		return nil
+	}
+	return &Limiter{rate: rate, profiles: profiles, now: time.Now}
+}
+
+// Rate returns the rate in bytes per second at the time t. Zero means no limit.
+func (l *Limiter) Rate(t time.Time) int64 {
+	for _, p := range l.profiles {
+		if fileflows.InTimeWindow(p.From, p.To, t) {
+			return p.Rate
+		}
+	}
+	return l.rate
+}
+
+// WaitN waits until n bytes can be transferred, or until the context is done. It returns the error of the context
+// when the wait is cut short.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	wait := l.reserve(n)
+	if wait <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reserve takes n bytes from the bucket and returns how long to wait before using them.
+// The bucket may go in debt: the next callers wait for it to be paid back, so the waits are served in order.
+func (l *Limiter) reserve(n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	rate := l.Rate(now)
+	if rate <= 0 {
+		l.tokens, l.last = 0, now
+		return 0
+	}
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	}
+	if burst := float64(rate); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// Reader returns a reader limited by all the limiters (nil limiters are ignored). The reads fail with the error of the
+// context as soon as it's done, even while they wait for the bandwidth.
+// If there is no limiter, r is returned as is.
+func Reader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	var used []*Limiter
+	for _, l := range limiters {
+		if l != nil {
+			used = append(used, l)
+		}
+	}
+
+	if len(used) == 0 {
+		return r
+	}
+	return &reader{ctx, r, used}
+}
+
+type reader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+func (t *reader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		for _, l := range t.limiters {
+			if err := l.WaitN(t.ctx, n); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, err
+}
+
+// FromConfig creates the Limiter matching a bandwidth limit and its profiles in the configuration.
+// It returns nil when there is no limit.
+func FromConfig(bandwidth int64, profiles []fileflows.BandwidthProfile) (*Limiter, error) {
+	var ps []Profile
+	for _, p := range profiles {
+		from, err := fileflows.ParseTimeOfDay(p.From)
+		if err != nil {
+			return nil, fmt.Errorf("bandwidth profile: %w", err)
+		}
+		to, err := fileflows.ParseTimeOfDay(p.To)
+		if err != nil {
+			return nil, fmt.Errorf("bandwidth profile: %w", err)
+		}
+		ps = append(ps, Profile{From: from, To: to, Rate: p.Limit})
+	}
+	return NewLimiter(bandwidth, ps), nil
+}
@@ -0,0 +1,118 @@
+package throttle
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestLimiterRateWithProfiles(t *testing.T) {
+	// Given
+	l := NewLimiter(1000, []Profile{
+		{From: 8 * time.Hour, To: 18 * time.Hour, Rate: 100},
+		{From: 22 * time.Hour, To: 6 * time.Hour, Rate: 0},
+	})
+
+	var tests = []struct {
+		hour int
+		rate int64
+	}{
+		{12, 100},
+		{19, 1000},
+		{23, 0},
+		{2, 0},
+		{7, 1000},
+	}
+
+	for _, test := range tests {
+		// When
+		rate := l.Rate(time.Date(2023, 6, 1, test.hour, 0, 0, 0, time.Local))
+
+		// Then
+		if rate != test.rate {
+			t.Errorf("Expected rate %d at %dh, got %d", test.rate, test.hour, rate)
+		}
+	}
+}
+
+func TestLimiterReserve(t *testing.T) {
+	// Given
+	now := time.Date(2023, 6, 1, 12, 0, 0, 0, time.Local)
+	l := NewLimiter(1000, nil)
+	l.now = func() time.Time { return now }
+
+	// When
+	first := l.reserve(500)
+	second := l.reserve(500)
+	now = now.Add(2 * time.Second)
+	third := l.reserve(1000)
+
+	// Then
+	if first != 500*time.Millisecond {
+		t.Errorf("Expected a wait of 500ms, got %v", first)
+	}
+
+	if second != time.Second {
+		t.Errorf("Expected a wait of 1s, got %v", second)
+	}
+
+	if third != 0 {
+		t.Errorf("Expected no wait after the debt is paid, got %v", third)
+	}
+}
+
+func TestReaderIsThrottled(t *testing.T) {
+	// Given
+	content := bytes.Repeat([]byte("x"), 64*1024)
+	l := NewLimiter(256*1024, nil)
+
+	// When
+	start := time.Now()
+	n, err := io.Copy(io.Discard, Reader(context.Background(), bytes.NewReader(content), l, nil))
+	elapsed := time.Since(start)
+
+	// Then
+	if err != nil || n != int64(len(content)) {
+		t.Fatalf("Expected %d bytes, got %d (%v)", len(content), n, err)
+	}
+
+	if elapsed < 200*time.Millisecond {
+		t.Errorf("Expected the copy to last about 250ms, got %v", elapsed)
+	}
+}
+
+func TestCanceledReaderStopsWaiting(t *testing.T) {
+	// Given
+	content := bytes.Repeat([]byte("x"), 64*1024)
+	l := NewLimiter(1024, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// When
+	start := time.Now()
+	_, err := io.Copy(io.Discard, Reader(ctx, bytes.NewReader(content), l))
+
+	// Then
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the copy to be canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the copy to stop at the deadline, got %v", elapsed)
+	}
+}
+
+func TestNoLimiter(t *testing.T) {
+	// Given
+	r := bytes.NewReader(nil)
+
+	// When
+	throttled := Reader(context.Background(), r, NewLimiter(0, nil))
+
+	// Then
+	if throttled != r {
+		t.Errorf("Expected the reader not to be throttled")
+	}
+}
@@ -0,0 +1,83 @@
+// Package tracing traces the cycles of the flows and the transfers of their files with OpenTelemetry.
+package tracing
+
+import (
+	"FileFlow/fileflows"
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+)
+
+// defaultServiceName is the service name of the traces when the configuration sets none.
+const defaultServiceName = "fileflow"
+
+// Attributes of the spans.
+const (
+	FlowKey        = attribute.Key("fileflow.flow")
+	FileKey        = attribute.Key("fileflow.file")
+	SizeKey        = attribute.Key("fileflow.file.size")
+	DestinationKey = attribute.Key("fileflow.destination")
+	OperationKey   = attribute.Key("fileflow.operation")
+	ResultKey      = attribute.Key("fileflow.result")
+	FilesKey       = attribute.Key("fileflow.files")
+	DispatchedKey  = attribute.Key("fileflow.dispatched")
+	FailedKey      = attribute.Key("fileflow.failed")
+)
+
+// Setup exports the traces to the collector of the configuration. It returns the function flushing the pending spans
+// and stopping the export. Without endpoint, nothing is traced.
+func Setup(config fileflows.TracingConfig) (shutdown func(context.Context) error, err error) {
+	if config.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(config.Endpoint)}
+	if len(config.Headers) > 0 {
+		options = append(options, otlptracehttp.WithHeaders(config.Headers))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot export traces to %s: %w", config.Endpoint, err)
+	}
+
+	serviceName := config.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	sampler := sdktrace.AlwaysSample()
+	if config.SampleRatio > 0 && config.SampleRatio < 1 {
+		sampler = sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		slog.Warn("Cannot export traces", "endpoint", config.Endpoint, "error", err)
+	}))
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of FileFlow.
+func Tracer() trace.Tracer {
+	return otel.Tracer("FileFlow")
+}
+
+// End ends the span, recording the error if any.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
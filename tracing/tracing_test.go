@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"FileFlow/fileflows"
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSetupExportsSpans(t *testing.T) {
+	// Given
+	var mu sync.Mutex
+	var paths, bodies []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		paths = append(paths, req.URL.Path)
+		bodies = append(bodies, string(body))
+	}))
+	defer collector.Close()
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+
+	shutdown, err := Setup(fileflows.TracingConfig{Endpoint: collector.URL, ServiceName: "fileflow-test"})
+	if err != nil {
+		t.Fatalf("Error setting tracing up: %s", err)
+	}
+
+	// When
+	_, span := Tracer().Start(context.Background(), "cycle")
+	span.SetAttributes(FlowKey.String("Move ACME files"))
+	End(span, errors.New("connection refused"))
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("Error shutting tracing down: %s", err)
+	}
+
+	// Then
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 1 || paths[0] != "/v1/traces" {
+		t.Fatalf("Expected 1 export to /v1/traces, got %v", paths)
+	}
+	for _, expected := range []string{"fileflow-test", "cycle", "Move ACME files", "connection refused"} {
+		if !strings.Contains(bodies[0], expected) {
+			t.Errorf("Expected %q in the exported spans", expected)
+		}
+	}
+}
+
+func TestSetupWithoutEndpoint(t *testing.T) {
+	shutdown, err := Setup(fileflows.TracingConfig{})
+	if err != nil {
+		t.Fatalf("Error setting tracing up: %s", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("Error shutting tracing down: %s", err)
+	}
+}